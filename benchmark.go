@@ -0,0 +1,45 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	benchmarkTimes    = []uint32{1, 2, 4, 8}
+	benchmarkMemories = []uint32{64 * 1024, 256 * 1024, 1024 * 1024}
+)
+
+func benchmark(w io.Writer, opts *options) {
+	total, ok := physicalMemory()
+
+	fmt.Fprintf(w, "Argon2id key derivation time (parallelism=%d)\n\n", opts.Threads)
+	fmt.Fprintf(w, "%6s", "time")
+	for _, memory := range benchmarkMemories {
+		fmt.Fprintf(w, "%12s", formatMemory(uint64(memory)))
+	}
+	fmt.Fprintln(w)
+
+	password := []byte("password")
+	salt := make([]byte, saltSize)
+	for _, t := range benchmarkTimes {
+		fmt.Fprintf(w, "%6d", t)
+		for _, memory := range benchmarkMemories {
+			if ok && uint64(memory)*1024 > total/10*8 {
+				fmt.Fprintf(w, "%12s", "-")
+				continue
+			}
+			start := time.Now()
+			argon2.IDKey(password, salt, t, memory, opts.Threads, chacha20poly1305.KeySize)
+			fmt.Fprintf(w, "%11.2fs", time.Since(start).Seconds())
+		}
+		fmt.Fprintln(w)
+	}
+}
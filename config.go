@@ -0,0 +1,132 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type configEntry struct {
+	key   string
+	value string
+}
+
+type config struct {
+	defaults []configEntry
+	presets  map[string][]configEntry
+	names    []string
+}
+
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "goenc", "config"), nil
+}
+
+func loadConfig(path string) (*config, error) {
+	cfg := &config{presets: make(map[string][]configEntry)}
+
+	fh, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	preset := ""
+	scanner := bufio.NewScanner(fh)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if name == "" {
+				return nil, fmt.Errorf("%s:%d: empty preset name", path, lineno)
+			}
+			if _, ok := cfg.presets[name]; ok {
+				return nil, fmt.Errorf("%s:%d: duplicate preset '%s'", path, lineno, name)
+			}
+			cfg.presets[name] = nil
+			cfg.names = append(cfg.names, name)
+			preset = name
+			continue
+		}
+		idx := strings.IndexByte(line, '=')
+		if idx < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineno)
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		switch key {
+		case "time", "memory", "parallelism":
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown key '%s'", path, lineno, key)
+		}
+		if err := setParameter(new(options), "--"+key, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+		entry := configEntry{key: key, value: value}
+		if preset == "" {
+			cfg.defaults = append(cfg.defaults, entry)
+		} else {
+			cfg.presets[preset] = append(cfg.presets[preset], entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func applyConfig(opts *options, preset string) error {
+	path, err := configPath()
+	if err != nil {
+		if preset != "" {
+			return err
+		}
+		return nil
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	entries := cfg.defaults
+	if preset != "" {
+		presetEntries, ok := cfg.presets[preset]
+		if !ok {
+			return fmt.Errorf("unknown preset '%s'", preset)
+		}
+		entries = append(entries, presetEntries...)
+	}
+	for _, entry := range entries {
+		if err := setParameter(opts, "--"+entry.key, entry.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func presetNames() ([]string, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.names, nil
+}
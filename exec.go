@@ -0,0 +1,65 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+type commandWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	closed bool
+}
+
+func newCommandWriter(command string) *commandWriter {
+	cmd := shellCommand(command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return &commandWriter{cmd: cmd}
+}
+
+func (cw *commandWriter) start() error {
+	stdin, err := cw.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cw.cmd.Start(); err != nil {
+		return err
+	}
+	cw.stdin = stdin
+	return nil
+}
+
+func (cw *commandWriter) Write(b []byte) (int, error) {
+	if cw.stdin == nil {
+		if err := cw.start(); err != nil {
+			return 0, err
+		}
+	}
+	if cw.closed {
+		return len(b), nil
+	}
+	n, err := cw.stdin.Write(b)
+	if errors.Is(err, syscall.EPIPE) {
+		// The command exited or closed its standard input early
+		cw.closed = true
+		return len(b), nil
+	}
+	return n, err
+}
+
+func (cw *commandWriter) Wait() error {
+	if cw.stdin == nil {
+		if err := cw.start(); err != nil {
+			return err
+		}
+	}
+	cw.stdin.Close()
+	return cw.cmd.Wait()
+}
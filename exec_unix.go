@@ -0,0 +1,14 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+)
+
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
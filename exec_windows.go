@@ -0,0 +1,25 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// shellCommand passes command to cmd.exe verbatim. exec.Command would quote
+// it by the msvcrt rules, which cmd.exe does not understand.
+func shellCommand(command string) *exec.Cmd {
+	shell := os.Getenv("ComSpec")
+	if shell == "" {
+		shell = filepath.Join(os.Getenv("SystemRoot"), "System32", "cmd.exe")
+	}
+	cmd := exec.Command(shell)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `/S /C "` + command + `"`}
+	return cmd
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+// +build go1.18
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func FuzzDecrypt(f *testing.F) {
+	// Keep the key derivation cheap whatever parameters the header asks for;
+	// the target is the parsing and authentication around it.
+	defer func(f func([]byte, []byte, uint32, uint32, uint8, uint32) []byte) { deriveKey = f }(deriveKey)
+	deriveKey = func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+		return argon2.IDKey(password, salt, 1, 8, 1, keyLen)
+	}
+
+	password := []byte("password")
+	ciphertext := testEncrypt(f, []byte("The secret message"), password, nil, &options{Time: 1, Memory: 8, Threads: 1})
+	f.Add(ciphertext)
+	f.Add(ciphertext[:headerSize])
+	f.Add(ciphertext[:overhead-1])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		plaintext := new(bytes.Buffer)
+		n, err := decrypt(bytes.NewReader(data), plaintext, password, nil, &options{Quiet: true})
+		if err != nil {
+			if plaintext.Len() != 0 {
+				t.Fatalf("wrote %d bytes before failing: %v", plaintext.Len(), err)
+			}
+			return
+		}
+		if n != plaintext.Len() || n != len(data)-overhead {
+			t.Fatalf("decrypted %d bytes (wrote %d) from %d bytes of input", n, plaintext.Len(), len(data))
+		}
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// fileInfo is the output of --info --json. Fields are only ever added, so
+// scripts can rely on the existing ones:
+//
+//	format    "v1"
+//	time      Argon2 time parameter
+//	memory    Argon2 memory parameter in bytes
+//	threads   Argon2 parallelism parameter
+//	salt_len  salt length in bytes
+type fileInfo struct {
+	Format  string `json:"format"`
+	Time    uint32 `json:"time"`
+	Memory  uint64 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	SaltLen int    `json:"salt_len"`
+}
+
+func readInfo(r io.Reader) (info *fileInfo, err error) {
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	var version uint8
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != formatV1 {
+		return nil, fmt.Errorf("invalid file format")
+	}
+
+	var header struct {
+		Time    uint32
+		Memory  uint32
+		Threads uint8
+		Salt    [saltSize]byte
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Time == 0 || header.Threads == 0 {
+		return nil, fmt.Errorf("invalid file format")
+	}
+	return &fileInfo{
+		Format:  formatName(version),
+		Time:    header.Time,
+		Memory:  uint64(header.Memory) * 1024,
+		Threads: header.Threads,
+		SaltLen: len(header.Salt),
+	}, nil
+}
+
+func printInfo(r io.Reader, w io.Writer, opts *options) error {
+	info, err := readInfo(r)
+	if err != nil {
+		return err
+	}
+	if opts.JSON {
+		return json.NewEncoder(w).Encode(info)
+	}
+	fmt.Fprintf(w, "Format:             %s\n", info.Format)
+	fmt.Fprintf(w, "Argon2 time:        %d\n", info.Time)
+	fmt.Fprintf(w, "Argon2 memory:      %s\n", formatMemory(info.Memory/1024))
+	fmt.Fprintf(w, "Argon2 parallelism: %d\n", info.Threads)
+	fmt.Fprintf(w, "Salt length:        %d bytes\n", info.SaltLen)
+	return nil
+}
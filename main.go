@@ -6,23 +6,56 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cions/goenc/prompt"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/term"
 )
 
-const saltSize = 16
+const (
+	formatV1      = 1
+	currentFormat = formatV1
+)
+
+func formatName(version uint8) string {
+	return fmt.Sprintf("v%d", version)
+}
+
+const (
+	saltSize   = 16
+	tagSize    = 16
+	headerSize = 1 + 4 + 4 + 1 + saltSize
+	overhead   = headerSize + chacha20poly1305.NonceSizeX + tagSize
+)
+
+var (
+	errInvalidTag     = errors.New("message authentication failed (password is wrong or data is corrupted)")
+	errInvalidKeySize = errors.New("invalid key size")
+	errRandomSource   = errors.New("failed to read from the random source")
+)
 
-var errInvalidTag = errors.New("message authentication failed (password is wrong or data is corrupted)")
+var (
+	deriveKey   = argon2.IDKey
+	totalMemory = physicalMemory
+)
 
 func getVersion() string {
 	if bi, ok := debug.ReadBuildInfo(); ok {
@@ -31,28 +64,112 @@ func getVersion() string {
 	return "(devel)"
 }
 
-func getPassword(confirm bool) ([]byte, error) {
+func readAskpass(fd int) ([]byte, error) {
+	// The standard streams stay open, since the input may still be read
+	// from standard input and the output written to standard output.
+	var fh *os.File
+	switch fd {
+	case 0:
+		fh = os.Stdin
+	case 1:
+		fh = os.Stdout
+	case 2:
+		fh = os.Stderr
+	default:
+		fh = os.NewFile(uintptr(fd), "askpass")
+		if fh == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		defer fh.Close()
+	}
+
+	// A descriptor open only for reading still supplies the password.
+	io.WriteString(fh, "Password: ")
+
+	var password []byte
+	b := make([]byte, 1)
+	for {
+		n, err := fh.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			if len(password) == cap(password) {
+				// Grow by hand, so that no stale copy is left behind.
+				grown := make([]byte, len(password), 2*cap(password)+64)
+				copy(grown, password)
+				zeroBytes(password)
+				password = grown
+			}
+			password = append(password, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			zeroBytes(password)
+			return nil, err
+		}
+	}
+	return bytes.TrimSuffix(password, []byte{'\r'}), nil
+}
+
+type passwordReader interface {
+	ReadRawAccepted(ctx context.Context, prompt string, transformer prompt.Transformer) ([]byte, bool, error)
+	Close() error
+}
+
+var newPasswordReader = func() (passwordReader, error) {
+	reader, err := prompt.NewReader()
+	if err != nil {
+		return nil, err
+	}
+	reader.LockMemory = true
+	return reader, nil
+}
+
+func getPassword(opts *options) ([]byte, error) {
+	if opts.AskpassFD >= 0 {
+		return readAskpass(opts.AskpassFD)
+	}
 	if val, ok := os.LookupEnv("PASSWORD"); ok {
 		return []byte(val), nil
 	}
+	confirm := opts.Operation == opEncrypt && opts.ConfirmPasswordFrom == ""
 
-	reader, err := prompt.NewReader()
+	reader, err := newPasswordReader()
 	if err != nil {
 		return nil, err
 	}
 	defer reader.Close()
 
-	password, err := reader.ReadPassword(context.Background(), "Password: ")
+	readPassword := func(msg string) ([]byte, error) {
+		password, accepted, err := reader.ReadRawAccepted(context.Background(), msg, prompt.Masked)
+		if err != nil {
+			zeroBytes(password)
+			return nil, err
+		}
+		if !accepted {
+			zeroBytes(password)
+			return nil, fmt.Errorf("failed to read the password: %w", io.ErrUnexpectedEOF)
+		}
+		return password, nil
+	}
+
+	password, err := readPassword("Password: ")
 	if err != nil {
 		return nil, err
 	}
 
 	if confirm {
-		confirmPassword, err := reader.ReadPassword(context.Background(), "Confirm Password: ")
+		confirmPassword, err := readPassword("Confirm Password: ")
 		if err != nil {
+			zeroBytes(password)
 			return nil, err
 		}
+		defer zeroBytes(confirmPassword)
 		if !bytes.Equal(password, confirmPassword) {
+			zeroBytes(password)
 			return nil, errors.New("passwords does not match")
 		}
 	}
@@ -60,34 +177,175 @@ func getPassword(confirm bool) ([]byte, error) {
 	return password, nil
 }
 
-func encrypt(r io.Reader, w io.Writer, opts *options) (n int, err error) {
-	password, err := getPassword(true)
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func confirmPasswordFrom(name string, password []byte) error {
+	data, err := os.ReadFile(name)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	defer zeroBytes(data)
+	confirmPassword := bytes.TrimSuffix(data, []byte{'\n'})
+	confirmPassword = bytes.TrimSuffix(confirmPassword, []byte{'\r'})
+	if !bytes.Equal(password, confirmPassword) {
+		return errors.New("passwords does not match")
+	}
+	return nil
+}
+
+type binaryGuard struct {
+	w       io.Writer
+	checked bool
+}
+
+func (bg *binaryGuard) Write(b []byte) (int, error) {
+	if !bg.checked {
+		head := b
+		if len(head) > 1024 {
+			head = head[:1024]
+		}
+		if bytes.IndexByte(head, 0) >= 0 {
+			return 0, errors.New("refusing to write binary data to a terminal (use --force or specify an output file)")
+		}
+		bg.checked = true
+	}
+	return bg.w.Write(b)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1024*1024*1024))
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KiB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+func formatMemory(kib uint64) string {
+	switch {
+	case kib != 0 && kib%(1024*1024) == 0:
+		return fmt.Sprintf("%d GiB", kib/(1024*1024))
+	case kib != 0 && kib%1024 == 0:
+		return fmt.Sprintf("%d MiB", kib/1024)
+	default:
+		return fmt.Sprintf("%d KiB", kib)
+	}
+}
+
+func dryRun(r io.Reader, w io.Writer, opts *options) error {
+	fmt.Fprintf(w, "Argon2 time:        %d\n", opts.Time)
+	fmt.Fprintf(w, "Argon2 memory:      %s\n", formatMemory(uint64(opts.Memory)))
+	fmt.Fprintf(w, "Argon2 parallelism: %d\n", opts.Threads)
+	if fh, ok := r.(*os.File); ok {
+		if stat, err := fh.Stat(); err == nil && stat.Mode().IsRegular() {
+			fmt.Fprintf(w, "Output size:        %d bytes\n", stat.Size()+overhead)
+			return nil
+		}
+	}
+	fmt.Fprintf(w, "Output size:        input size + %d bytes\n", overhead)
+	return nil
+}
+
+func useColor(opts *options) bool {
+	when := "auto"
+	if opts != nil {
+		when = opts.Color
+	}
+	switch when {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || runtime.GOOS == "windows" {
+		return false
+	}
+	return term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+func label(opts *options, name, color string) string {
+	if !useColor(opts) {
+		return name
+	}
+	return "\x1b[" + color + "m" + name + "\x1b[m"
+}
+
+func warnf(opts *options, format string, a ...interface{}) {
+	if opts.Quiet {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "goenc: "+label(opts, "warning:", "1;33")+" "+format+"\n", a...)
+}
+
+// checkMemory applies the same rule when encrypting and decrypting, so
+// goenc never writes a file it would then refuse to read on the same host.
+// Without --force, a memory parameter above physical memory is refused,
+// since the allocation would abort the process instead of failing cleanly
+// (a crafted header can ask for up to 4 TiB).
+func checkMemory(opts *options) error {
+	total, ok := totalMemory()
+	if !ok {
+		return nil
+	}
+	memory := uint64(opts.Memory) * 1024
+	if memory > total && !opts.Force {
+		return fmt.Errorf("Argon2 memory parameter (%s) exceeds physical memory (%s) (use --force to try anyway)", formatMemory(uint64(opts.Memory)), formatMemory(total/(1024*1024)*1024))
 	}
+	if memory > total/10*8 {
+		warnf(opts, "Argon2 memory parameter (%s) exceeds 80%% of physical memory (%s)", formatMemory(uint64(opts.Memory)), formatMemory(total/(1024*1024)*1024))
+	}
+	return nil
+}
 
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("%w: %d bytes, expected %d", errInvalidKeySize, len(key), chacha20poly1305.KeySize)
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+func encrypt(r io.Reader, w io.Writer, password, ad []byte, opts *options) (n int, err error) {
 	header := new(bytes.Buffer)
-	header.WriteByte(1)
+	header.WriteByte(currentFormat)
 	binary.Write(header, binary.LittleEndian, opts.Time)
 	binary.Write(header, binary.LittleEndian, opts.Memory)
 	binary.Write(header, binary.LittleEndian, opts.Threads)
 
 	salt := make([]byte, saltSize)
 	if _, err := rand.Read(salt); err != nil {
-		return 0, err
+		return 0, fmt.Errorf("generating salt: %w: %v", errRandomSource, err)
 	}
 	header.Write(salt)
 
-	key := argon2.IDKey(password, salt, opts.Time, opts.Memory, opts.Threads, chacha20poly1305.KeySize)
+	key := deriveKey(password, salt, opts.Time, opts.Memory, opts.Threads, chacha20poly1305.KeySize)
 
-	aead, err := chacha20poly1305.NewX(key)
+	aead, err := newAEAD(key)
 	if err != nil {
 		return 0, err
 	}
 
 	nonce := make([]byte, chacha20poly1305.NonceSizeX)
 	if _, err := rand.Read(nonce); err != nil {
-		return 0, err
+		return 0, fmt.Errorf("generating nonce: %w: %v", errRandomSource, err)
 	}
 
 	plaintext, err := io.ReadAll(r)
@@ -99,7 +357,9 @@ func encrypt(r io.Reader, w io.Writer, opts *options) (n int, err error) {
 	if len(plaintext)+aead.Overhead() <= cap(plaintext) {
 		dst = plaintext[:0]
 	}
+	header.Write(ad)
 	ciphertext := aead.Seal(dst, nonce, plaintext, header.Bytes())
+	header.Truncate(headerSize)
 
 	n1, err := header.WriteTo(w)
 	if err != nil {
@@ -122,25 +382,20 @@ func encrypt(r io.Reader, w io.Writer, opts *options) (n int, err error) {
 	return n, nil
 }
 
-func decrypt(r io.Reader, w io.Writer, opts *options) (n int, err error) {
+func decrypt(r io.Reader, w io.Writer, password, ad []byte, opts *options) (n int, err error) {
 	defer func() {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
 	}()
 
-	password, err := getPassword(false)
-	if err != nil {
-		return 0, err
-	}
-
 	header := new(bytes.Buffer)
 
 	var version uint8
 	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
 		return 0, err
 	}
-	if version != 1 {
+	if version != formatV1 {
 		return 0, fmt.Errorf("invalid file format")
 	}
 	header.WriteByte(version)
@@ -160,15 +415,22 @@ func decrypt(r io.Reader, w io.Writer, opts *options) (n int, err error) {
 	}
 	binary.Write(header, binary.LittleEndian, opts.Threads)
 
+	if opts.Time == 0 || opts.Threads == 0 {
+		return 0, fmt.Errorf("invalid file format")
+	}
+	if err := checkMemory(opts); err != nil {
+		return 0, err
+	}
+
 	salt := make([]byte, saltSize)
 	if _, err := io.ReadFull(r, salt); err != nil {
 		return 0, err
 	}
 	header.Write(salt)
 
-	key := argon2.IDKey(password, salt, opts.Time, opts.Memory, opts.Threads, chacha20poly1305.KeySize)
+	key := deriveKey(password, salt, opts.Time, opts.Memory, opts.Threads, chacha20poly1305.KeySize)
 
-	aead, err := chacha20poly1305.NewX(key)
+	aead, err := newAEAD(key)
 	if err != nil {
 		return 0, err
 	}
@@ -186,6 +448,7 @@ func decrypt(r io.Reader, w io.Writer, opts *options) (n int, err error) {
 		return 0, io.ErrUnexpectedEOF
 	}
 
+	header.Write(ad)
 	plaintext, err := aead.Open(ciphertext[:0], nonce, ciphertext, header.Bytes())
 	if err != nil {
 		return 0, errInvalidTag
@@ -194,63 +457,271 @@ func decrypt(r io.Reader, w io.Writer, opts *options) (n int, err error) {
 	return w.Write(plaintext)
 }
 
-func main() {
-	opts, err := parseArgs(os.Args[1:])
+func verifyOutput(out output, password, ad, sum []byte, opts *options) error {
+	fh, err := out.Reopen()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "goenc: error: %v\n", err)
-		os.Exit(2)
+		return err
 	}
+	defer fh.Close()
 
-	if opts.Operation == opHelp {
-		fmt.Println(helpMessage)
-		os.Exit(0)
+	// decrypt overwrites the parameters it reads, and encrypt has already
+	// warned about them.
+	vopts := *opts
+	vopts.Quiet = true
+	digest := sha256.New()
+	if _, err := decrypt(fh, digest, password, ad, &vopts); err != nil {
+		return fmt.Errorf("verification failed: %w", err)
 	}
-	if opts.Operation == opVersion {
-		fmt.Printf("goenc %s (%s/%s)\n", getVersion(), runtime.GOOS, runtime.GOARCH)
-		os.Exit(0)
+	if !bytes.Equal(digest.Sum(nil), sum) {
+		return errors.New("verification failed: decrypted data does not match the input")
 	}
+	return nil
+}
 
+// abortOnSignal aborts out and exits on SIGHUP, SIGINT or SIGTERM until
+// stop has returned. commit and stop take the same lock as the handler, so
+// a signal never interrupts them half way; stop aborts out unless it was
+// committed.
+func abortOnSignal(out output) (commit func() error, stop func()) {
+	var mu sync.Mutex
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signalCh:
+			mu.Lock()
+			if out != nil {
+				out.Abort()
+			}
+			if ssig, ok := sig.(syscall.Signal); ok {
+				os.Exit(128 + int(ssig))
+			}
+			os.Exit(2)
+		case <-done:
+		}
+	}()
+	commit = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.Commit()
+	}
+	stop = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if out != nil {
+			out.Abort()
+		}
+		signal.Stop(signalCh)
+		close(done)
+	}
+	return commit, stop
+}
+
+func run(opts *options) error {
 	var r io.Reader = os.Stdin
 	var w io.Writer = os.Stdout
-	if opts.Input != "-" {
+	if isURL(opts.Input) {
+		body, err := openURL(opts.Input, opts.Timeout)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		r = body
+	} else if opts.Input != "-" {
 		fh, err := os.Open(opts.Input)
+		if errors.Is(err, fs.ErrNotExist) && (opts.Operation == opDecrypt || opts.Operation == opInfo) {
+			if names, err2 := findVolumes(opts.Input); err2 != nil {
+				return err2
+			} else if names != nil {
+				r, err = openVolumes(names)
+			}
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "goenc: error: %v\n", err)
-			os.Exit(2)
+			return err
 		}
-		defer fh.Close()
-		r = fh
+		if fh != nil {
+			defer fh.Close()
+			r = fh
+		} else {
+			defer r.(io.Closer).Close()
+		}
+	}
+	if opts.Operation == opInfo {
+		return printInfo(r, os.Stdout, opts)
 	}
-	if opts.Output != "-" {
-		flags := os.O_WRONLY | os.O_CREATE
-		if opts.NoClobber {
-			flags |= os.O_EXCL
+	if opts.DryRun {
+		return dryRun(r, os.Stdout, opts)
+	}
+
+	if opts.Output == "-" && opts.Exec == "" && !opts.Force && term.IsTerminal(int(os.Stdout.Fd())) {
+		if opts.Operation == opEncrypt {
+			return errors.New("refusing to write encrypted data to a terminal (use --force or specify an output file)")
 		}
-		fh, err := os.OpenFile(opts.Output, flags, 0o644)
+		w = &binaryGuard{w: w}
+	}
+
+	var cw *commandWriter
+	if opts.Exec != "" {
+		cw = newCommandWriter(opts.Exec)
+		w = cw
+	}
+
+	var out output
+	if opts.Split > 0 {
+		out = createSplitOutput(opts.Output, opts.Split, opts.Mode, opts.NoClobber)
+	} else if opts.Output != "-" {
+		fh, err := createOutput(opts.Output, opts.Mode, opts.NoClobber)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "goenc: error: %v\n", err)
-			os.Exit(2)
+			return err
 		}
-		defer fh.Close()
-		w = fh
+		out = fh
+	}
+	if out != nil {
+		defer out.Abort()
+		w = out
 	}
 
+	if opts.Operation == opEncrypt {
+		if err := checkMemory(opts); err != nil {
+			return err
+		}
+	}
+	password, err := getPassword(opts)
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(password)
+	if opts.ConfirmPasswordFrom != "" {
+		if err := confirmPasswordFrom(opts.ConfirmPasswordFrom, password); err != nil {
+			return err
+		}
+	}
+	if opts.Operation == opEncrypt && passwordStrength(password) < 2 {
+		warnf(opts, "the password is weak; consider a longer passphrase")
+	}
+
+	var ad []byte
+	if opts.BindFilename {
+		name := opts.Output
+		if opts.Operation == opDecrypt {
+			name = opts.Input
+		}
+		ad = []byte(filepath.Base(name))
+	}
+
+	commit, stop := abortOnSignal(out)
+	defer stop()
+	cr := &countingReader{r: r}
+	start := time.Now()
 	var n int
 	if opts.Operation == opEncrypt {
-		n, err = encrypt(r, w, opts)
+		var in io.Reader = cr
+		digest := sha256.New()
+		if opts.VerifyAfter {
+			in = io.TeeReader(cr, digest)
+		}
+		n, err = encrypt(in, w, password, ad, opts)
+		if err == nil && opts.VerifyAfter {
+			err = verifyOutput(out, password, ad, digest.Sum(nil), opts)
+		}
 	} else {
-		n, err = decrypt(r, w, opts)
+		n, err = decrypt(cr, w, password, ad, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cw != nil {
+		if err := cw.Wait(); err != nil {
+			return err
+		}
+	} else if out != nil {
+		if err := commit(); err != nil {
+			return err
+		}
+	} else if stat, err := os.Stdout.Stat(); err == nil && stat.Mode().IsRegular() {
+		if off, err := os.Stdout.Seek(0, io.SeekCurrent); err == nil {
+			if err := os.Stdout.Truncate(off); err != nil {
+				return err
+			}
+		}
 	}
-	if fh, ok := w.(*os.File); ok && err == nil {
-		if stat, err2 := fh.Stat(); err2 == nil && stat.Mode().IsRegular() {
-			err = fh.Truncate(int64(n))
+
+	if opts.Stats {
+		verb := "encrypted"
+		if opts.Operation == opDecrypt {
+			verb = "decrypted"
 		}
+		fmt.Fprintf(os.Stderr, "goenc: %s %s in %.1fs, output %s (time=%d, memory=%s, parallelism=%d)\n",
+			verb, formatSize(cr.n), time.Since(start).Seconds(), formatSize(int64(n)),
+			opts.Time, formatMemory(uint64(opts.Memory)), opts.Threads)
 	}
+	return nil
+}
+
+func main() {
+	opts, err := parseArgs(os.Args[1:])
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "goenc: %s %v\n", label(opts, "error:", "1;31"), err)
+		os.Exit(2)
+	}
+
+	if opts.Operation == opHelp {
+		fmt.Println(helpMessage)
+		os.Exit(0)
+	}
+	if opts.Operation == opVersion {
+		fmt.Printf("goenc %s (%s/%s)\n", getVersion(), runtime.GOOS, runtime.GOARCH)
+		os.Exit(0)
+	}
+	if opts.Operation == opBenchmark {
+		benchmark(os.Stdout, opts)
+		os.Exit(0)
+	}
+	if opts.Operation == opSelftest {
+		if err := selftest(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "goenc: %s %v\n", label(opts, "error:", "1;31"), err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+	if opts.Operation == opListOptions {
+		for _, name := range longOptions() {
+			fmt.Println(name)
+		}
+		os.Exit(0)
+	}
+	if opts.Operation == opListFormats {
+		fmt.Println(formatName(formatV1))
+		os.Exit(0)
+	}
+	if opts.Operation == opListPresets {
+		names, err := presetNames()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "goenc: %s %v\n", label(opts, "error:", "1;31"), err)
+			os.Exit(2)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		os.Exit(0)
+	}
+
+	if err := run(opts); err != nil {
 		if se, ok := err.(*prompt.SignalError); ok {
 			os.Exit(128 + se.Signal())
 		}
-		fmt.Fprintf(os.Stderr, "goenc: error: %v\n", err)
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				os.Exit(128 + int(ws.Signal()))
+			}
+			if ee.ExitCode() >= 0 {
+				os.Exit(ee.ExitCode())
+			}
+		}
+		fmt.Fprintf(os.Stderr, "goenc: %s %v\n", label(opts, "error:", "1;31"), err)
 		if errors.Is(err, errInvalidTag) {
 			os.Exit(1)
 		}
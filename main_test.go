@@ -0,0 +1,322 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cions/goenc/prompt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func testEncrypt(tb testing.TB, plaintext, password, ad []byte, opts *options) []byte {
+	tb.Helper()
+	ciphertext := new(bytes.Buffer)
+	if _, err := encrypt(bytes.NewReader(plaintext), ciphertext, password, ad, opts); err != nil {
+		tb.Fatal(err)
+	}
+	return ciphertext.Bytes()
+}
+
+func TestHeaderIsAuthenticated(t *testing.T) {
+	// Derive the key from the salt alone and lift the memory limit, so that
+	// a tampered parameter is only caught if the header is part of the
+	// additional data.
+	defer func(f func([]byte, []byte, uint32, uint32, uint8, uint32) []byte) { deriveKey = f }(deriveKey)
+	deriveKey = func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+		return argon2.IDKey(password, salt, 1, 8, 1, keyLen)
+	}
+	defer func(f func() (uint64, bool)) { totalMemory = f }(totalMemory)
+	totalMemory = func() (uint64, bool) { return 0, false }
+
+	password := []byte("password")
+	ciphertext := testEncrypt(t, []byte("The secret message"), password, nil, &options{Time: 3, Memory: 8, Threads: 3})
+	for i := 1; i < headerSize; i++ {
+		tampered := append([]byte(nil), ciphertext...)
+		tampered[i] ^= 0x01
+		_, err := decrypt(bytes.NewReader(tampered), io.Discard, password, nil, &options{Quiet: true})
+		if !errors.Is(err, errInvalidTag) {
+			t.Errorf("flipped header byte %d: got %v, want %v", i, err, errInvalidTag)
+		}
+	}
+}
+
+var benchmarkSizes = []struct {
+	name string
+	size int
+}{
+	{"1KiB", 1024},
+	{"1MiB", 1024 * 1024},
+	{"64MiB", 64 * 1024 * 1024},
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	password := []byte("password")
+	opts := &options{Time: 1, Memory: 8, Threads: 1}
+	for _, bm := range benchmarkSizes {
+		b.Run(bm.name, func(b *testing.B) {
+			plaintext := make([]byte, bm.size)
+			b.SetBytes(int64(bm.size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := encrypt(bytes.NewReader(plaintext), io.Discard, password, nil, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	password := []byte("password")
+	for _, bm := range benchmarkSizes {
+		b.Run(bm.name, func(b *testing.B) {
+			ciphertext := testEncrypt(b, make([]byte, bm.size), password, nil, &options{Time: 1, Memory: 8, Threads: 1})
+			b.SetBytes(int64(bm.size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := decrypt(bytes.NewReader(ciphertext), io.Discard, password, nil, &options{Quiet: true}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkKDF(b *testing.B) {
+	opts := &options{Time: 8, Memory: 1 * 1024 * 1024, Threads: 4} // the defaults
+	password := []byte("password")
+	salt := make([]byte, saltSize)
+	for i := 0; i < b.N; i++ {
+		argon2.IDKey(password, salt, opts.Time, opts.Memory, opts.Threads, chacha20poly1305.KeySize)
+	}
+}
+
+func setenv(tb testing.TB, key, value string) {
+	tb.Helper()
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestPasswordFromEnvironmentIsNotConfirmed(t *testing.T) {
+	defer func(f func() (passwordReader, error)) { newPasswordReader = f }(newPasswordReader)
+	newPasswordReader = func() (passwordReader, error) {
+		t.Error("prompted for the password")
+		return nil, errors.New("no terminal")
+	}
+	setenv(t, "PASSWORD", "correct horse")
+
+	for _, op := range []operation{opEncrypt, opDecrypt} {
+		password, err := getPassword(&options{Operation: op, AskpassFD: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(password) != "correct horse" {
+			t.Errorf("got password %q, want %q", password, "correct horse")
+		}
+	}
+}
+
+func TestConfirmPasswordFrom(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		content string
+		ok      bool
+	}{
+		{"correct horse", true},
+		{"correct horse\n", true},
+		{"correct horse\r\n", true},
+		{"correct horse\n\n", false},
+		{"correct horsE", false},
+		{"", false},
+	} {
+		name := filepath.Join(dir, "password")
+		if err := os.WriteFile(name, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := confirmPasswordFrom(name, []byte("correct horse")); (err == nil) != tt.ok {
+			t.Errorf("confirm against %q: got %v", tt.content, err)
+		}
+	}
+}
+
+func TestFormatNameMatchesInfo(t *testing.T) {
+	defer func(f func([]byte, []byte, uint32, uint32, uint8, uint32) []byte) { deriveKey = f }(deriveKey)
+	deriveKey = func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+		return argon2.IDKey(password, salt, 1, 8, 1, keyLen)
+	}
+
+	ciphertext := testEncrypt(t, []byte("plaintext"), []byte("password"), nil, &options{Time: 1, Memory: 8, Threads: 1})
+	info, err := readInfo(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := formatName(currentFormat); info.Format != want {
+		t.Errorf("got format %q, want %q", info.Format, want)
+	}
+	if info.Format != "v1" {
+		t.Errorf("got format %q, want %q", info.Format, "v1")
+	}
+}
+
+func TestMemoryAbovePhysicalMemory(t *testing.T) {
+	defer func(f func([]byte, []byte, uint32, uint32, uint8, uint32) []byte) { deriveKey = f }(deriveKey)
+	deriveKey = func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+		return argon2.IDKey(password, salt, 1, 8, 1, keyLen)
+	}
+	defer func(f func() (uint64, bool)) { totalMemory = f }(totalMemory)
+	totalMemory = func() (uint64, bool) { return 4096, true }
+
+	// Encrypting and decrypting follow the same rule, so a file written
+	// on this host can always be read back on it.
+	password := []byte("password")
+	if err := checkMemory(&options{Memory: 8, Quiet: true}); err == nil {
+		t.Error("encrypt: memory above physical memory was accepted without --force")
+	}
+	if err := checkMemory(&options{Memory: 8, Quiet: true, Force: true}); err != nil {
+		t.Errorf("encrypt: memory above physical memory was refused with --force: %v", err)
+	}
+	ciphertext := testEncrypt(t, []byte("plaintext"), password, nil, &options{Time: 1, Memory: 8, Threads: 1})
+	if _, err := decrypt(bytes.NewReader(ciphertext), io.Discard, password, nil, &options{Quiet: true}); err == nil {
+		t.Error("decrypt: memory above physical memory was accepted without --force")
+	}
+	if _, err := decrypt(bytes.NewReader(ciphertext), io.Discard, password, nil, &options{Quiet: true, Force: true}); err != nil {
+		t.Errorf("decrypt: memory above physical memory was refused with --force: %v", err)
+	}
+}
+
+func TestReadAskpassKeepsStandardInput(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		io.WriteString(w, "correct horse\r\nciphertext")
+		w.Close()
+	}()
+	defer func(f *os.File) { os.Stdin = f }(os.Stdin)
+	os.Stdin = r
+
+	// The prompt cannot be written to the read end of a pipe.
+	password, err := readAskpass(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password) != "correct horse" {
+		t.Errorf("got password %q, want %q", password, "correct horse")
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("standard input was closed: %v", err)
+	}
+	if string(rest) != "ciphertext" {
+		t.Errorf("got input %q, want %q", rest, "ciphertext")
+	}
+}
+
+type fakePasswordReader struct {
+	lines    []string
+	accepted bool
+	returned [][]byte
+}
+
+func (f *fakePasswordReader) ReadRawAccepted(ctx context.Context, msg string, transformer prompt.Transformer) ([]byte, bool, error) {
+	line := []byte(f.lines[0])
+	f.lines = f.lines[1:]
+	f.returned = append(f.returned, line)
+	return line, f.accepted, nil
+}
+
+func (f *fakePasswordReader) Close() error {
+	return nil
+}
+
+func TestRejectedPasswordsAreZeroed(t *testing.T) {
+	defer func(f func() (passwordReader, error)) { newPasswordReader = f }(newPasswordReader)
+	if old, ok := os.LookupEnv("PASSWORD"); ok {
+		defer os.Setenv("PASSWORD", old)
+		os.Unsetenv("PASSWORD")
+	}
+
+	for _, tt := range []struct {
+		name     string
+		lines    []string
+		accepted bool
+	}{
+		{"not accepted", []string{"correct horse"}, false},
+		{"confirmation does not match", []string{"correct horse", "correct horsE"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakePasswordReader{lines: tt.lines, accepted: tt.accepted}
+			newPasswordReader = func() (passwordReader, error) { return fake, nil }
+			if _, err := getPassword(&options{Operation: opEncrypt, AskpassFD: -1}); err == nil {
+				t.Fatal("password was accepted")
+			}
+			for _, b := range fake.returned {
+				if !bytes.Equal(b, make([]byte, len(b))) {
+					t.Errorf("rejected password was not zeroed: %q", b)
+				}
+			}
+		})
+	}
+
+	// The confirmation is discarded even when it matches.
+	fake := &fakePasswordReader{lines: []string{"correct horse", "correct horse"}, accepted: true}
+	newPasswordReader = func() (passwordReader, error) { return fake, nil }
+	password, err := getPassword(&options{Operation: opEncrypt, AskpassFD: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password) != "correct horse" {
+		t.Errorf("got password %q, want %q", password, "correct horse")
+	}
+	if confirmation := fake.returned[1]; !bytes.Equal(confirmation, make([]byte, len(confirmation))) {
+		t.Errorf("confirmation was not zeroed: %q", confirmation)
+	}
+}
+
+func TestAbortOnSignalStop(t *testing.T) {
+	for _, committed := range []bool{false, true} {
+		dir := t.TempDir()
+		name := filepath.Join(dir, "out")
+		out, err := createOutput(name, 0o600, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit, stop := abortOnSignal(out)
+		if _, err := out.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if committed {
+			if err := commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stop()
+
+		if _, err := os.Stat(name); (err == nil) != committed {
+			t.Errorf("committed=%v: output exists: %v", committed, err == nil)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(matches) != 0 {
+			t.Errorf("committed=%v: temporary files left behind: %q", committed, matches)
+		}
+	}
+}
@@ -6,26 +6,86 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math/bits"
+	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const helpMessage = `usage: goenc [options] [input] [output]
 
 A simple file encryption tool
 
+When decrypting, input may be an http:// or https:// URL.
+
 Options:
  -e, --encrypt          Encrypt
  -d, --decrypt          Decrypt
  -n, --no-clobber       Do not overwrite an existing file
+ -f, --force            Write encrypted or binary data to a terminal, and
+                        allow an Argon2 memory parameter larger than
+                        physical memory
+     --mode=MODE        File mode (in octal) of a newly created output file,
+                        masked by the umask (default: 600); the mode of the
+                        input file is not copied
+     --auto-name        Derive the output file name from the input: append
+                        SUFFIX when encrypting, remove it when decrypting
+     --strip-suffix     Same as --auto-name (for use with --decrypt)
+     --suffix=SUFFIX    File name suffix of encrypted files (default: .goenc)
+     --exec=COMMAND     Run COMMAND with the shell and pass the decrypted
+                        data to its standard input instead of writing it
+                        out; exit with the exit status of COMMAND
+     --timeout=DURATION Time limit for fetching a URL input (e.g. 30s, 2m)
+     --bind-filename    Authenticate the file name of the encrypted file
+                        (the output when encrypting, the input when
+                        decrypting); the file is not marked as bound, so
+                        decrypting it without this option fails as if the
+                        password were wrong
+     --verify-after     Decrypt the output file after encrypting and check
+                        that it matches the input
+     --split=SIZE[kMG]  Split the encrypted output into volumes OUTPUT.000,
+                        OUTPUT.001, ... of at most SIZE bytes each
+                        (decryption finds the volumes automatically)
+     --askpass-fd=N     Write the password prompt to and read the password
+                        from file descriptor N (the first line is read;
+                        the prompt is skipped if N is not writable)
+     --confirm-password-from=FILE
+                        Check the encryption password against the contents
+                        of FILE instead of asking for it twice
+     --preset=NAME      Use the Argon2 parameters of a preset defined in the
+                        configuration file
  -t, --time=N           Argon2 time parameter (default: 8)
  -m, --memory=N[kMG]    Argon2 memory parameter (default: 1G)
+                        Suffixes are case-insensitive and also accepted
+                        in IEC form (Ki, Mi, Gi, KiB, MiB, GiB)
  -p, --parallelism=N    Argon2 parallelism parameter (default: 4)
+                        "auto" uses the number of CPUs (at most 255)
+     --stats            Print a summary of the operation to stderr
+     --color=WHEN       Color warnings and errors: auto, always or never
+                        (default: auto)
+     --info             Print the parameters of an encrypted file and exit
+     --json             Print --info output as JSON
+     --dry-run          Print the encryption parameters and the expected
+                        output size, and exit without encrypting
+ -q, --quiet            Do not print warnings
+     --benchmark        Print Argon2id timings for a range of time and
+                        memory parameters, and exit
+     --selftest         Check that encryption and decryption work as expected,
+                        and exit
  -h, --help             Show this help message and exit
      --version          Show version information and exit
 
-Environment Variable:
+Configuration File:
+  goenc/config in the user configuration directory (e.g. ~/.config/goenc/config)
+  sets the default Argon2 parameters and defines presets. Options given on
+  the command line take precedence.
+
+Environment Variables:
   PASSWORD              Encryption password
+  NO_COLOR              Disable colors unless --color=always is given
 
 Exit Status:
   0  Operation was successful
@@ -37,42 +97,191 @@ type operation int
 const (
 	opEncrypt operation = iota
 	opDecrypt
+	opInfo
+	opBenchmark
+	opSelftest
+	opListOptions
+	opListFormats
+	opListPresets
 	opHelp
 	opVersion
 )
 
 type options struct {
-	Operation operation
-	NoClobber bool
-	Time      uint32
-	Memory    uint32
-	Threads   uint8
-	Input     string
-	Output    string
+	Operation           operation
+	NoClobber           bool
+	Force               bool
+	DryRun              bool
+	BindFilename        bool
+	VerifyAfter         bool
+	Stats               bool
+	Quiet               bool
+	JSON                bool
+	Color               string
+	Mode                os.FileMode
+	Split               int64
+	AutoName            bool
+	Suffix              string
+	Exec                string
+	Timeout             time.Duration
+	AskpassFD           int
+	ConfirmPasswordFrom string
+	Time                uint32
+	Memory              uint32
+	Threads             uint8
+	Input               string
+	Output              string
 }
 
 var takeValue = map[string]bool{
-	"-e":            false,
-	"--encrypt":     false,
-	"-d":            false,
-	"--decrypt":     false,
-	"-n":            false,
-	"--no-clobber":  false,
-	"-t":            true,
-	"--time":        true,
-	"-m":            true,
-	"--memory":      true,
-	"-p":            true,
-	"--parallelism": true,
-	"-h":            false,
-	"--help":        false,
-	"--version":     false,
+	"-e":                      false,
+	"--encrypt":               false,
+	"-d":                      false,
+	"--decrypt":               false,
+	"-n":                      false,
+	"--no-clobber":            false,
+	"-f":                      false,
+	"--force":                 false,
+	"--mode":                  true,
+	"--auto-name":             false,
+	"--strip-suffix":          false,
+	"--suffix":                true,
+	"--exec":                  true,
+	"--timeout":               true,
+	"--bind-filename":         false,
+	"--verify-after":          false,
+	"--split":                 true,
+	"--askpass-fd":            true,
+	"--confirm-password-from": true,
+	"--preset":                true,
+	"-t":                      true,
+	"--time":                  true,
+	"-m":                      true,
+	"--memory":                true,
+	"-p":                      true,
+	"--parallelism":           true,
+	"--info":                  false,
+	"--json":                  false,
+	"--dry-run":               false,
+	"--benchmark":             false,
+	"--selftest":              false,
+	"--stats":                 false,
+	"--color":                 true,
+	"-q":                      false,
+	"--quiet":                 false,
+	"-h":                      false,
+	"--help":                  false,
+	"--list-options":          false,
+	"--list-formats":          false,
+	"--list-presets":          false,
+	"--version":               false,
+}
+
+func longOptions() []string {
+	var names []string
+	for name := range takeValue {
+		if strings.HasPrefix(name, "--") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func autoThreads() uint8 {
+	if n := runtime.NumCPU(); n < 255 {
+		return uint8(n)
+	}
+	return 255
+}
+
+// parseSize parses N[kMG] in multiples of baseUnit bytes, where a bare N
+// counts baseUnit bytes, and checks that the result fits in bitSize bits.
+func parseSize(name, value string, baseUnit uint64, bitSize int) (uint64, error) {
+	unit := baseUnit
+	if idx := strings.IndexFunc(value, func(r rune) bool { return r < '0' || '9' < r }); idx >= 0 {
+		switch strings.ToLower(value[idx:]) {
+		case "k", "ki", "kib":
+			unit = 1 << 10
+		case "m", "mi", "mib":
+			unit = 1 << 20
+		case "g", "gi", "gib":
+			unit = 1 << 30
+		default:
+			return 0, fmt.Errorf("option %s expects a number (with optional suffix k, M or G)", name)
+		}
+		value = value[:idx]
+	}
+	unit /= baseUnit
+	v, err := strconv.ParseUint(value, 10, bitSize-(bits.Len64(unit)-1))
+	if err != nil {
+		if errors.Is(err, strconv.ErrSyntax) {
+			return 0, fmt.Errorf("option %s expects a number (with optional suffix k, M or G)", name)
+		}
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("option %s: value out of range", name)
+		}
+		return 0, fmt.Errorf("option %s: %w", name, err)
+	}
+	return v * unit, nil
+}
+
+func setParameter(opts *options, name, value string) error {
+	switch name {
+	case "-t", "--time":
+		v, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			if errors.Is(err, strconv.ErrSyntax) {
+				return fmt.Errorf("option %s expects a number", name)
+			}
+			if errors.Is(err, strconv.ErrRange) {
+				return fmt.Errorf("option %s: value out of range", name)
+			}
+			return fmt.Errorf("option %s: %w", name, err)
+		}
+		if v == 0 {
+			return fmt.Errorf("option %s: value out of range", name)
+		}
+		opts.Time = uint32(v)
+	case "-m", "--memory":
+		v, err := parseSize(name, value, 1024, 32)
+		if err != nil {
+			return err
+		}
+		opts.Memory = uint32(v)
+	case "-p", "--parallelism":
+		if value == "auto" {
+			opts.Threads = autoThreads()
+			break
+		}
+		v, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			if errors.Is(err, strconv.ErrSyntax) {
+				return fmt.Errorf("option %s expects a number or auto", name)
+			}
+			if errors.Is(err, strconv.ErrRange) {
+				return fmt.Errorf("option %s: value out of range", name)
+			}
+			return fmt.Errorf("option %s: %w", name, err)
+		}
+		if v == 0 {
+			return fmt.Errorf("option %s: value out of range", name)
+		}
+		opts.Threads = uint8(v)
+	default:
+		return fmt.Errorf("unknown option '%s'", name)
+	}
+	return nil
 }
 
 func parseArgs(args []string) (*options, error) {
 	opts := &options{
 		Operation: opEncrypt,
 		NoClobber: false,
+		Mode:      0o600,
+		Suffix:    ".goenc",
+		Color:     "auto",
+		AskpassFD: -1,
 		Time:      8,
 		Memory:    1 * 1024 * 1024,
 		Threads:   4,
@@ -81,6 +290,9 @@ func parseArgs(args []string) (*options, error) {
 	}
 
 	var posargs []string
+	var params [][2]string
+	preset := ""
+	stripSuffix := false
 	for len(args) > 0 {
 		var name, value string
 		switch {
@@ -142,45 +354,53 @@ func parseArgs(args []string) (*options, error) {
 			opts.Operation = opDecrypt
 		case "-n", "--no-clobber":
 			opts.NoClobber = true
-		case "-t", "--time":
-			v, err := strconv.ParseUint(value, 10, 32)
+		case "-f", "--force":
+			opts.Force = true
+		case "--mode":
+			v, err := strconv.ParseUint(value, 8, 9)
 			if err != nil {
 				if errors.Is(err, strconv.ErrSyntax) {
-					return nil, fmt.Errorf("option %s expects a number", name)
+					return nil, fmt.Errorf("option %s expects an octal number", name)
 				}
 				if errors.Is(err, strconv.ErrRange) {
 					return nil, fmt.Errorf("option %s: value out of range", name)
 				}
 				return nil, fmt.Errorf("option %s: %w", name, err)
 			}
-			opts.Time = uint32(v)
-		case "-m", "--memory":
-			unit := uint64(1)
-			width := 32
-			if strings.HasSuffix(value, "k") {
-				value = strings.TrimSuffix(value, "k")
-			} else if strings.HasSuffix(value, "M") {
-				value = strings.TrimSuffix(value, "M")
-				unit = 1024
-				width -= 10
-			} else if strings.HasSuffix(value, "G") {
-				value = strings.TrimSuffix(value, "G")
-				unit = 1024 * 1024
-				width -= 20
+			opts.Mode = os.FileMode(v)
+		case "--auto-name":
+			opts.AutoName = true
+		case "--strip-suffix":
+			opts.AutoName = true
+			stripSuffix = true
+		case "--suffix":
+			if value == "" {
+				return nil, fmt.Errorf("option %s requires a non-empty value", name)
+			}
+			opts.Suffix = value
+		case "--exec":
+			opts.Exec = value
+		case "--timeout":
+			v, err := time.ParseDuration(value)
+			if err != nil || v <= 0 {
+				return nil, fmt.Errorf("option %s expects a positive duration (e.g. 30s)", name)
 			}
-			v, err := strconv.ParseUint(value, 10, width)
+			opts.Timeout = v
+		case "--bind-filename":
+			opts.BindFilename = true
+		case "--verify-after":
+			opts.VerifyAfter = true
+		case "--split":
+			v, err := parseSize(name, value, 1, 63)
 			if err != nil {
-				if errors.Is(err, strconv.ErrSyntax) {
-					return nil, fmt.Errorf("option %s expects a number (with optional suffix k, M or G)", name)
-				}
-				if errors.Is(err, strconv.ErrRange) {
-					return nil, fmt.Errorf("option %s: value out of range", name)
-				}
-				return nil, fmt.Errorf("option %s: %w", name, err)
+				return nil, err
 			}
-			opts.Memory = uint32(v * unit)
-		case "-p", "--parallelism":
-			v, err := strconv.ParseUint(value, 10, 8)
+			if v == 0 {
+				return nil, fmt.Errorf("option %s: value out of range", name)
+			}
+			opts.Split = int64(v)
+		case "--askpass-fd":
+			v, err := strconv.ParseUint(value, 10, 31)
 			if err != nil {
 				if errors.Is(err, strconv.ErrSyntax) {
 					return nil, fmt.Errorf("option %s expects a number", name)
@@ -190,17 +410,69 @@ func parseArgs(args []string) (*options, error) {
 				}
 				return nil, fmt.Errorf("option %s: %w", name, err)
 			}
-			opts.Threads = uint8(v)
+			opts.AskpassFD = int(v)
+		case "--confirm-password-from":
+			opts.ConfirmPasswordFrom = value
+		case "-t", "--time", "-m", "--memory", "-p", "--parallelism":
+			params = append(params, [2]string{name, value})
+		case "--preset":
+			preset = value
+		case "--stats":
+			opts.Stats = true
+		case "--color":
+			switch value {
+			case "auto", "always", "never":
+				opts.Color = value
+			default:
+				return nil, fmt.Errorf("option %s expects auto, always or never", name)
+			}
+		case "-q", "--quiet":
+			opts.Quiet = true
+		case "--dry-run":
+			opts.DryRun = true
+		case "--info":
+			opts.Operation = opInfo
+		case "--json":
+			opts.JSON = true
+		case "--benchmark":
+			opts.Operation = opBenchmark
+		case "--selftest":
+			opts.Operation = opSelftest
 		case "-h", "--help":
 			opts.Operation = opHelp
 			return opts, nil
 		case "--version":
 			opts.Operation = opVersion
 			return opts, nil
+		case "--list-options":
+			opts.Operation = opListOptions
+			return opts, nil
+		case "--list-formats":
+			opts.Operation = opListFormats
+			return opts, nil
+		case "--list-presets":
+			opts.Operation = opListPresets
+			return opts, nil
 		default:
 			return nil, fmt.Errorf("unknown option '%s'", name)
 		}
 	}
+	if opts.Operation == opBenchmark {
+		opts.Threads = autoThreads()
+	}
+	if preset != "" && opts.Operation != opEncrypt && opts.Operation != opBenchmark {
+		return nil, errors.New("option --preset can only be used with --encrypt or --benchmark")
+	}
+	if opts.Operation == opEncrypt || opts.Operation == opBenchmark {
+		if err := applyConfig(opts, preset); err != nil {
+			return nil, err
+		}
+	}
+	for _, param := range params {
+		if err := setParameter(opts, param[0], param[1]); err != nil {
+			return nil, err
+		}
+	}
 	if len(posargs) >= 1 {
 		opts.Input = posargs[0]
 	}
@@ -210,5 +482,85 @@ func parseArgs(args []string) (*options, error) {
 	if len(posargs) >= 3 {
 		return nil, errors.New("too many arguments")
 	}
+	if isURL(opts.Input) {
+		if opts.Operation != opDecrypt && opts.Operation != opInfo {
+			return nil, errors.New("URL input can only be used with --decrypt or --info")
+		}
+		if opts.AutoName {
+			return nil, errors.New("option --auto-name cannot be used with URL input")
+		}
+		if opts.BindFilename {
+			return nil, errors.New("option --bind-filename cannot be used with URL input")
+		}
+	} else if opts.Timeout > 0 {
+		return nil, errors.New("option --timeout requires URL input")
+	}
+	if stripSuffix && opts.Operation != opDecrypt {
+		return nil, errors.New("option --strip-suffix can only be used with --decrypt")
+	}
+	if opts.AutoName {
+		if opts.Input == "-" {
+			return nil, errors.New("option --auto-name requires an input file")
+		}
+		if len(posargs) >= 2 {
+			return nil, errors.New("option --auto-name cannot be used with an output file")
+		}
+		switch opts.Operation {
+		case opEncrypt:
+			opts.Output = opts.Input + opts.Suffix
+		case opDecrypt:
+			if !strings.HasSuffix(opts.Input, opts.Suffix) || len(opts.Input) == len(opts.Suffix) {
+				return nil, fmt.Errorf("input file name does not end with '%s'", opts.Suffix)
+			}
+			opts.Output = strings.TrimSuffix(opts.Input, opts.Suffix)
+		}
+	}
+	if opts.BindFilename {
+		if opts.Operation == opEncrypt && opts.Output == "-" {
+			return nil, errors.New("option --bind-filename requires an output file")
+		}
+		if opts.Operation == opDecrypt && opts.Input == "-" {
+			return nil, errors.New("option --bind-filename requires an input file")
+		}
+	}
+	if opts.VerifyAfter {
+		if opts.Operation != opEncrypt {
+			return nil, errors.New("option --verify-after can only be used with --encrypt")
+		}
+		if opts.Output == "-" {
+			return nil, errors.New("option --verify-after requires an output file")
+		}
+	}
+	if opts.Split > 0 {
+		if opts.Operation != opEncrypt {
+			return nil, errors.New("option --split can only be used with --encrypt")
+		}
+		if opts.Output == "-" {
+			return nil, errors.New("option --split requires an output file")
+		}
+	}
+	if opts.AskpassFD == 1 && opts.Output == "-" && opts.Exec == "" && (opts.Operation == opEncrypt || opts.Operation == opDecrypt) {
+		return nil, errors.New("option --askpass-fd cannot use standard output while the output is written to it")
+	}
+	if opts.ConfirmPasswordFrom != "" && opts.Operation != opEncrypt {
+		return nil, errors.New("option --confirm-password-from can only be used with --encrypt")
+	}
+	if opts.Exec != "" {
+		if opts.Operation != opDecrypt {
+			return nil, errors.New("option --exec can only be used with --decrypt")
+		}
+		if opts.Output != "-" {
+			return nil, errors.New("option --exec cannot be used with an output file")
+		}
+	}
+	if opts.JSON && opts.Operation != opInfo {
+		return nil, errors.New("option --json can only be used with --info")
+	}
+	if opts.Operation == opInfo && len(posargs) >= 2 {
+		return nil, errors.New("option --info takes no output file")
+	}
+	if opts.DryRun && opts.Operation != opEncrypt {
+		return nil, errors.New("option --dry-run can only be used with --encrypt")
+	}
 	return opts, nil
 }
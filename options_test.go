@@ -0,0 +1,66 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		baseUnit uint64
+		bitSize  int
+		want     uint64
+		ok       bool
+	}{
+		{"64", 1024, 32, 64, true},
+		{"64k", 1024, 32, 64, true},
+		{"64KiB", 1024, 32, 64, true},
+		{"64M", 1024, 32, 64 << 10, true},
+		{"1G", 1024, 32, 1 << 20, true},
+		{"4095G", 1024, 32, 4095 << 20, true},
+		{"4096G", 1024, 32, 0, false},
+		{"4294967295", 1024, 32, 1<<32 - 1, true},
+		{"4294967296", 1024, 32, 0, false},
+		{"64", 1, 63, 64, true},
+		{"64k", 1, 63, 64 << 10, true},
+		{"64mib", 1, 63, 64 << 20, true},
+		{"2g", 1, 63, 2 << 30, true},
+		{"8589934591G", 1, 63, 8589934591 << 30, true},
+		{"8589934592G", 1, 63, 0, false},
+		{"", 1, 63, 0, false},
+		{"k", 1, 63, 0, false},
+		{"64T", 1, 63, 0, false},
+		{"-1", 1, 63, 0, false},
+		{"1.5G", 1, 63, 0, false},
+	} {
+		got, err := parseSize("--size", tt.value, tt.baseUnit, tt.bitSize)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseSize(%q, %d, %d): got error %v", tt.value, tt.baseUnit, tt.bitSize, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q, %d, %d) = %d, want %d", tt.value, tt.baseUnit, tt.bitSize, got, tt.want)
+		}
+	}
+}
+
+func TestParseArgsRejects(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-d", "--preset=fast"}, "option --preset can only be used with --encrypt or --benchmark"},
+		{[]string{"--info", "--preset=fast"}, "option --preset can only be used with --encrypt or --benchmark"},
+		{[]string{"--selftest", "--preset=fast"}, "option --preset can only be used with --encrypt or --benchmark"},
+		{[]string{"-d", "--bind-filename", "https://example.com/file.goenc?token=x"}, "option --bind-filename cannot be used with URL input"},
+		{[]string{"--askpass-fd=1", "input"}, "option --askpass-fd cannot use standard output while the output is written to it"},
+	} {
+		_, err := parseArgs(tt.args)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parseArgs(%q): got error %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
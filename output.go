@@ -0,0 +1,164 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type output interface {
+	io.Writer
+	Reopen() (io.ReadCloser, error)
+	Commit() error
+	Abort()
+}
+
+type outputFile struct {
+	*os.File
+	path      string
+	noClobber bool
+	closed    bool
+	published bool
+}
+
+// checkClobber is the single no-clobber policy: with -n, nothing that
+// exists at name (including a dangling symlink) is ever replaced.
+func checkClobber(op, name string, noClobber bool) error {
+	if !noClobber {
+		return nil
+	}
+	if _, err := os.Lstat(name); err == nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	return nil
+}
+
+func createOutput(name string, mode os.FileMode, noClobber bool) (*outputFile, error) {
+	if err := checkClobber("open", name, noClobber); err != nil {
+		return nil, err
+	}
+	keepMode := false
+	if stat, err := os.Stat(name); err == nil {
+		if !stat.Mode().IsRegular() {
+			fh, err := os.OpenFile(name, os.O_WRONLY, 0)
+			if err != nil {
+				return nil, err
+			}
+			return &outputFile{File: fh}, nil
+		}
+		if name, err = filepath.EvalSymlinks(name); err != nil {
+			return nil, err
+		}
+		mode = stat.Mode().Perm()
+		keepMode = true
+	}
+
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	fh, err := createTemp(dir, base, mode)
+	if err != nil {
+		return nil, err
+	}
+	// An existing file keeps its mode exactly, while a new one is subject
+	// to the umask like any other newly created file.
+	if keepMode {
+		if err := fh.Chmod(mode); err != nil {
+			fh.Close()
+			os.Remove(fh.Name())
+			return nil, err
+		}
+	}
+	return &outputFile{File: fh, path: name, noClobber: noClobber}, nil
+}
+
+// createTemp is like os.CreateTemp, but creates the file with mode.
+func createTemp(dir, base string, mode os.FileMode) (*os.File, error) {
+	for i := 0; ; i++ {
+		var suffix [4]byte
+		if _, err := rand.Read(suffix[:]); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, "."+base+"."+hex.EncodeToString(suffix[:])+".tmp")
+		fh, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if errors.Is(err, fs.ErrExist) && i < 100 {
+			continue
+		}
+		return fh, err
+	}
+}
+
+func (f *outputFile) Reopen() (io.ReadCloser, error) {
+	return os.Open(f.Name())
+}
+
+func (f *outputFile) Commit() error {
+	if err := f.finish(); err != nil || f.path == "" {
+		return err
+	}
+	if err := f.publish(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// finish syncs and closes the temporary file without publishing it, so
+// that several files can be made durable before any of them replaces
+// what is on disk.
+func (f *outputFile) finish() error {
+	f.closed = true
+	if f.path == "" {
+		return f.Close()
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// publish moves the finished temporary file to its destination. With -n
+// it is linked instead of renamed, which fails atomically if anything has
+// appeared at the destination since createOutput.
+func (f *outputFile) publish() error {
+	if f.noClobber {
+		if err := os.Link(f.Name(), f.path); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		f.published = true
+		return os.Remove(f.Name())
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	f.published = true
+	return nil
+}
+
+func (f *outputFile) Abort() {
+	if f.published {
+		return
+	}
+	if !f.closed {
+		f.closed = true
+		f.Close()
+	}
+	if f.path != "" {
+		os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeOutput(out output, data string) error {
+	if _, err := out.Write([]byte(data)); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+func assertContent(t *testing.T, name, want string) {
+	t.Helper()
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s: got %q, want %q", name, got, want)
+	}
+}
+
+func assertNoTemporaryFiles(t *testing.T, dir string) {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, ".*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("temporary files left behind: %q", matches)
+	}
+}
+
+func TestCreateOutputNoClobber(t *testing.T) {
+	for _, noClobber := range []bool{false, true} {
+		dir := t.TempDir()
+
+		missing := filepath.Join(dir, "missing")
+		fh, err := createOutput(missing, 0o600, noClobber)
+		if err != nil {
+			t.Fatalf("noClobber=%v: missing target: %v", noClobber, err)
+		}
+		if err := writeOutput(fh, "new"); err != nil {
+			t.Fatal(err)
+		}
+		assertContent(t, missing, "new")
+
+		existing := filepath.Join(dir, "existing")
+		if err := os.WriteFile(existing, []byte("old"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		fh, err = createOutput(existing, 0o600, noClobber)
+		if noClobber {
+			if !errors.Is(err, fs.ErrExist) {
+				t.Errorf("existing target: got %v, want %v", err, fs.ErrExist)
+			}
+			assertContent(t, existing, "old")
+		} else {
+			if err != nil {
+				t.Fatalf("existing target: %v", err)
+			}
+			if err := writeOutput(fh, "new"); err != nil {
+				t.Fatal(err)
+			}
+			assertContent(t, existing, "new")
+		}
+
+		dangling := filepath.Join(dir, "dangling")
+		if err := os.Symlink(filepath.Join(dir, "nowhere"), dangling); err != nil {
+			t.Skip(err)
+		}
+		fh, err = createOutput(dangling, 0o600, noClobber)
+		if noClobber {
+			if !errors.Is(err, fs.ErrExist) {
+				t.Errorf("dangling symlink: got %v, want %v", err, fs.ErrExist)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("dangling symlink: %v", err)
+			}
+			if err := writeOutput(fh, "new"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertNoTemporaryFiles(t, dir)
+	}
+}
+
+func TestCommitNoClobber(t *testing.T) {
+	for _, noClobber := range []bool{false, true} {
+		dir := t.TempDir()
+		name := filepath.Join(dir, "out")
+		fh, err := createOutput(name, 0o600, noClobber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fh.Write([]byte("new")); err != nil {
+			t.Fatal(err)
+		}
+
+		// The target appears while the temporary file is being written;
+		// with -n, publishing it must fail rather than replace the target.
+		if err := os.WriteFile(name, []byte("old"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		err = fh.Commit()
+		if noClobber {
+			if !errors.Is(err, fs.ErrExist) {
+				t.Errorf("commit: got %v, want %v", err, fs.ErrExist)
+			}
+			assertContent(t, name, "old")
+		} else {
+			if err != nil {
+				t.Fatalf("commit: %v", err)
+			}
+			assertContent(t, name, "new")
+		}
+		assertNoTemporaryFiles(t, dir)
+	}
+}
+
+func TestSplitOutputNoClobber(t *testing.T) {
+	for _, noClobber := range []bool{false, true} {
+		dir := t.TempDir()
+		name := filepath.Join(dir, "out")
+
+		// A stale volume beyond the ones about to be written.
+		stale := volumeName(name, 2)
+		if err := os.WriteFile(stale, []byte("old"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		err := writeOutput(createSplitOutput(name, 4, 0o600, noClobber), "abcdefg")
+		if noClobber {
+			if !errors.Is(err, fs.ErrExist) {
+				t.Errorf("stale volume: got %v, want %v", err, fs.ErrExist)
+			}
+			for _, i := range []int{0, 1} {
+				if _, err := os.Lstat(volumeName(name, i)); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("volume %d was written: %v", i, err)
+				}
+			}
+			assertContent(t, stale, "old")
+		} else {
+			if err != nil {
+				t.Fatalf("stale volume: %v", err)
+			}
+			assertContent(t, volumeName(name, 0), "abcd")
+			assertContent(t, volumeName(name, 1), "efg")
+			if _, err := os.Lstat(stale); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("stale volume was kept: %v", err)
+			}
+		}
+		assertNoTemporaryFiles(t, dir)
+
+		// An existing volume that would be overwritten.
+		os.Remove(stale)
+		first := volumeName(name, 0)
+		if err := os.WriteFile(first, []byte("old"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		err = writeOutput(createSplitOutput(name, 4, 0o600, noClobber), "abcdefg")
+		if noClobber {
+			if !errors.Is(err, fs.ErrExist) {
+				t.Errorf("existing volume: got %v, want %v", err, fs.ErrExist)
+			}
+			assertContent(t, first, "old")
+		} else {
+			if err != nil {
+				t.Fatalf("existing volume: %v", err)
+			}
+			assertContent(t, first, "abcd")
+		}
+		assertNoTemporaryFiles(t, dir)
+	}
+}
+
+func TestSplitOutputCommitFailure(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		blocked      int
+		inconsistent bool
+	}{
+		{"first volume", 0, false},
+		{"second volume", 1, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "out")
+			for i := 0; i < 2; i++ {
+				if err := os.WriteFile(volumeName(name, i), []byte("old"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			out := createSplitOutput(name, 4, 0o600, false)
+			if _, err := out.Write([]byte("abcdefg")); err != nil {
+				t.Fatal(err)
+			}
+
+			// A non-empty directory cannot be renamed over.
+			blocked := volumeName(name, tt.blocked)
+			os.Remove(blocked)
+			if err := os.MkdirAll(filepath.Join(blocked, "dir"), 0o700); err != nil {
+				t.Fatal(err)
+			}
+
+			err := out.Commit()
+			if err == nil {
+				t.Fatal("commit succeeded")
+			}
+			if got := strings.Contains(err.Error(), "mixes new and old volumes"); got != tt.inconsistent {
+				t.Errorf("reported an inconsistent set: got %v, want %v (%v)", got, tt.inconsistent, err)
+			}
+			if tt.blocked == 0 {
+				assertContent(t, volumeName(name, 1), "old")
+			} else {
+				assertContent(t, volumeName(name, 0), "abcd")
+			}
+			assertNoTemporaryFiles(t, dir)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCreateOutputMode(t *testing.T) {
+	umask := syscall.Umask(0o022)
+	defer syscall.Umask(umask)
+
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		mode os.FileMode
+		want os.FileMode
+	}{
+		{0o600, 0o600},
+		{0o644, 0o644},
+		{0o777, 0o755},
+	} {
+		name := filepath.Join(dir, tt.mode.String())
+		fh, err := createOutput(name, tt.mode, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeOutput(fh, "new"); err != nil {
+			t.Fatal(err)
+		}
+		stat, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stat.Mode().Perm(); got != tt.want {
+			t.Errorf("--mode=%o: got %o, want %o", tt.mode, got, tt.want)
+		}
+	}
+
+	// An existing file keeps its mode, even where the umask would mask it.
+	existing := filepath.Join(dir, "existing")
+	if err := os.WriteFile(existing, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(existing, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := createOutput(existing, 0o600, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOutput(fh, "new"); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stat.Mode().Perm(); got != 0o666 {
+		t.Errorf("existing file: got %o, want %o", got, 0o666)
+	}
+}
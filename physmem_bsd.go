@@ -0,0 +1,27 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+func physicalMemory() (uint64, bool) {
+	name := "hw.physmem"
+	switch runtime.GOOS {
+	case "darwin":
+		name = "hw.memsize"
+	case "netbsd", "openbsd":
+		name = "hw.physmem64"
+	}
+	size, err := unix.SysctlUint64(name)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import "golang.org/x/sys/unix"
+
+func physicalMemory() (uint64, bool) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, false
+	}
+	return uint64(info.Totalram) * uint64(info.Unit), true
+}
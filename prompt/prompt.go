@@ -8,11 +8,13 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 	"unicode/utf8"
 
 	"golang.org/x/term"
@@ -20,9 +22,12 @@ import (
 )
 
 var (
-	mask   = []byte{'*'}
 	bs     = []byte{'\b'}
+	bel    = "\a"
 	clreos = "\x1b[J"      // Clear to end of screen
+	swrap  = "\x1b[?7s"    // Save Auto-Wrap Mode
+	ewrap  = "\x1b[?7h"    // Enable Auto-Wrap Mode
+	rwrap  = "\x1b[?7r"    // Restore Auto-Wrap Mode
 	ebp    = "\x1b[?2004h" // Enable Bracketed Paste Mode
 	dbp    = "\x1b[?2004l" // Disable Bracketed Paste Mode
 )
@@ -45,6 +50,7 @@ const (
 	actKillWholeLine
 	actQuotedInsert
 	actRefresh
+	actUndo
 	actPasteStart
 	actPasteEnd
 )
@@ -65,6 +71,8 @@ type contextReader struct {
 	ctx      context.Context
 	signalCh <-chan os.Signal
 	r        io.Reader
+	warnCh   <-chan time.Time
+	warn     func()
 }
 
 type readResult struct {
@@ -84,20 +92,43 @@ func (cr *contextReader) Read(b []byte) (n int, err error) {
 		}
 		ch <- readResult{b: bb[:n], err: err}
 	}()
-	select {
-	case sig := <-cr.signalCh:
-		if ssig, ok := sig.(syscall.Signal); ok {
-			return 0, &SignalError{sig: ssig}
+	for {
+		select {
+		case sig := <-cr.signalCh:
+			if ssig, ok := sig.(syscall.Signal); ok {
+				return 0, &SignalError{sig: ssig}
+			}
+			return 0, errors.New("caught signal: " + sig.String())
+		case <-cr.ctx.Done():
+			return 0, cr.ctx.Err()
+		case <-cr.warnCh:
+			cr.warnCh = nil
+			cr.warn()
+		case retval := <-ch:
+			copy(b, retval.b)
+			return len(retval.b), retval.err
 		}
-		return 0, errors.New("caught signal: " + sig.String())
-	case <-cr.ctx.Done():
-		return 0, cr.ctx.Err()
-	case retval := <-ch:
-		copy(b, retval.b)
-		return len(retval.b), retval.err
 	}
 }
 
+// newContextReader returns a contextReader for reading a line. The
+// deadline warning is delivered while it waits for input, so that every
+// write to the terminal comes from the goroutine editing the line. With
+// less than DeadlineWarning left, the bell does not ring at all.
+func (r *reader) newContextReader(ctx context.Context, signalCh <-chan os.Signal) (cr *contextReader, stop func()) {
+	cr = &contextReader{ctx: ctx, signalCh: signalCh, r: r}
+	stop = func() {}
+	if deadline, ok := ctx.Deadline(); ok && r.DeadlineWarning > 0 {
+		if d := time.Until(deadline) - r.DeadlineWarning; d > 0 {
+			timer := time.NewTimer(d)
+			cr.warnCh = timer.C
+			cr.warn = func() { io.WriteString(r, bel) }
+			stop = func() { timer.Stop() }
+		}
+	}
+	return cr, stop
+}
+
 type tty interface {
 	io.Reader
 	io.Writer
@@ -108,6 +139,49 @@ type tty interface {
 
 type reader struct {
 	tty
+
+	// LockMemory allocates line buffers from dedicated pages locked out of
+	// swap where the platform permits it, so unlocking one buffer never
+	// unlocks another. Intermediate buffers are zeroed and freed, while the
+	// returned line stays locked until the process exits.
+	LockMemory bool
+
+	// NoFinalNewline leaves the cursor at the end of the input and
+	// bracketed paste enabled on return, for callers that manage the
+	// screen themselves.
+	NoFinalNewline bool
+
+	// Simple reads input without echo, cursor movement or bracketed paste,
+	// for terminals that do not understand escape sequences. NewReader
+	// enables it when TERM is "dumb".
+	Simple bool
+
+	// NoBracketedPaste neither enables bracketed paste nor treats pasted
+	// text specially, for terminals that handle the mode badly.
+	NoBracketedPaste bool
+
+	// DeadlineWarning rings the bell this long before the context deadline
+	// passes, to warn that the prompt is about to time out. Zero disables it.
+	DeadlineWarning time.Duration
+
+	// Hint, if set, returns a short text shown after the input and updated
+	// as it is edited, such as a password strength meter. It must not
+	// reveal the input and is cleared when reading ends.
+	Hint func(line []byte) string
+
+	locked  map[*byte]bool
+	pending []byte
+}
+
+// Read returns input that ReadChar has read ahead before reading the
+// terminal again.
+func (r *reader) Read(b []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(b, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	return r.tty.Read(b)
 }
 
 func scanToken(data []byte, atEOF bool) (int, []byte, error) {
@@ -122,16 +196,27 @@ func scanToken(data []byte, atEOF bool) (int, []byte, error) {
 		_, n := utf8.DecodeRune(data)
 		return n, data[:n], nil
 	}
-	if len(data) >= 3 && data[1] == '[' {
+	if len(data) == 1 && !atEOF {
+		return 0, nil, nil
+	}
+	if len(data) >= 2 && data[1] == '[' {
 		i := 2
 		for i < len(data) && ('0' <= data[i] && data[i] <= '9' || data[i] == ';') {
 			i++
 		}
+		if i == len(data) && !atEOF {
+			return 0, nil, nil
+		}
 		if i < len(data) && ('A' <= data[i] && data[i] <= 'Z' || data[i] == '~') {
 			return i + 1, data[:i+1], nil
 		}
-	} else if len(data) >= 3 && data[1] == 'O' && ('A' <= data[2] && data[2] <= 'Z') {
-		return 3, data[:3], nil
+	} else if len(data) >= 2 && data[1] == 'O' {
+		if len(data) == 2 && !atEOF {
+			return 0, nil, nil
+		}
+		if len(data) >= 3 && 'A' <= data[2] && data[2] <= 'Z' {
+			return 3, data[:3], nil
+		}
 	}
 	return 1, data[:1], nil
 }
@@ -179,6 +264,8 @@ func tokenToAction(token []byte, inPaste bool) action {
 		return actQuotedInsert
 	case 0x1b: // ^[
 		break
+	case 0x1f: // ^_
+		return actUndo
 	case 0x1c: // ^\
 		if runtime.GOOS == "windows" {
 			return actIgnore
@@ -229,13 +316,29 @@ func NewReader() (*reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &reader{tty}, nil
+	return &reader{tty: tty, Simple: os.Getenv("TERM") == "dumb"}, nil
+}
+
+const maxUndo = 16
+
+type snapshot struct {
+	buf []byte
+	pos int
+}
+
+type lineOptions struct {
+	allow     func(rune) bool
+	endMarker []byte
 }
 
+// Transformer converts input into what is echoed and returns the number of
+// columns it occupies. The cursor is moved back with backspaces, so dst
+// must not contain control characters such as tabs whose width depends on
+// the cursor position.
 type Transformer func(src []byte) (dst []byte, width int)
 
 func CaretNotation(b []byte) ([]byte, int) {
-	dst := make([]byte, len(b))
+	dst := make([]byte, 0, len(b))
 	n := 0
 
 	for len(b) > 0 {
@@ -243,6 +346,12 @@ func CaretNotation(b []byte) ([]byte, int) {
 		if r < 0x20 || r == 0x7f {
 			dst = append(dst, '^', byte(r)^0x40)
 			n += 2
+		} else if 0x80 <= r && r <= 0x9f {
+			dst = append(dst, fmt.Sprintf("\\x%02x", r)...)
+			n += 4
+		} else if r == utf8.RuneError && size == 1 {
+			dst = append(dst, fmt.Sprintf("\\x%02x", b[0])...)
+			n += 4
 		} else {
 			dst = append(dst, b[:size]...)
 			switch width.LookupRune(r).Kind() {
@@ -258,16 +367,76 @@ func CaretNotation(b []byte) ([]byte, int) {
 	return dst, n
 }
 
+var maskedWithAsterisks = MaskedWith('*')
+
 func Masked(b []byte) ([]byte, int) {
-	n := utf8.RuneCount(b)
-	return bytes.Repeat(mask, n), n
+	return maskedWithAsterisks(b)
+}
+
+func MaskedWith(r rune) Transformer {
+	mask := []byte(string(r))
+	w := 1
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		w = 2
+	}
+	return func(b []byte) ([]byte, int) {
+		n := utf8.RuneCount(b)
+		return bytes.Repeat(mask, n), n * w
+	}
 }
 
 func NoDisplay(b []byte) ([]byte, int) {
 	return []byte{}, 0
 }
 
+func (r *reader) newBuffer(size int) []byte {
+	if r.LockMemory && size > 0 {
+		if b := allocLocked(size); b != nil {
+			if r.locked == nil {
+				r.locked = make(map[*byte]bool)
+			}
+			r.locked[&b[0]] = true
+			return b[:0]
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+func (r *reader) appendBuffer(b []byte, data ...byte) []byte {
+	if len(b)+len(data) > cap(b) {
+		newBuf := append(r.newBuffer(2*(len(b)+len(data))), b...)
+		r.releaseBuffer(b)
+		b = newBuf
+	}
+	return append(b, data...)
+}
+
+func (r *reader) releaseBuffer(b []byte) {
+	b = b[:cap(b)]
+	for i := range b {
+		b[i] = 0
+	}
+	if len(b) > 0 && r.locked[&b[0]] {
+		delete(r.locked, &b[0])
+		freeLocked(b)
+	}
+}
+
 func (r *reader) ReadRaw(ctx context.Context, prompt string, transformer Transformer) ([]byte, error) {
+	line, _, err := r.readLine(ctx, prompt, transformer, lineOptions{})
+	return line, err
+}
+
+func (r *reader) ReadRawAccepted(ctx context.Context, prompt string, transformer Transformer) ([]byte, bool, error) {
+	return r.readLine(ctx, prompt, transformer, lineOptions{})
+}
+
+func (r *reader) readLine(ctx context.Context, prompt string, transformer Transformer, opts lineOptions) (line []byte, accepted bool, err error) {
+	if r.Simple {
+		return r.readLineSimple(ctx, prompt, opts)
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -275,38 +444,125 @@ func (r *reader) ReadRaw(ctx context.Context, prompt string, transformer Transfo
 	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	defer signal.Stop(signalCh)
 
-	scanner := bufio.NewScanner(&contextReader{ctx: ctx, signalCh: signalCh, r: r})
+	cr, stopWarning := r.newContextReader(ctx, signalCh)
+	defer stopWarning()
+	scanner := bufio.NewScanner(cr)
 	scanner.Split(scanToken)
-	password := make([]byte, 0, 256)
+	password := r.newBuffer(256)
+	var text []byte
+	defer func() {
+		if err != nil {
+			r.releaseBuffer(password)
+			if text != nil {
+				r.releaseBuffer(text)
+			}
+		}
+	}()
 	pos := 0
 	inPaste := false
+	prevCR := false
+
+	var undo []snapshot
+	defer func() {
+		for _, snap := range undo {
+			r.releaseBuffer(snap.buf)
+		}
+	}()
+	pushUndo := func() {
+		if len(undo) == maxUndo {
+			r.releaseBuffer(undo[0].buf)
+			undo = append(undo[:0], undo[1:]...)
+		}
+		buf := append(r.newBuffer(cap(password)), password...)
+		undo = append(undo, snapshot{buf: buf, pos: pos})
+	}
 
 	state, err := r.MakeRaw()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer func() {
 		if pos < len(password) {
 			out, _ := transformer(password[pos:])
 			r.Write(out)
 		}
-		io.WriteString(r, "\r\n"+dbp)
+		if r.Hint != nil {
+			io.WriteString(r, clreos)
+		}
+		if !r.NoFinalNewline {
+			io.WriteString(r, "\r\n")
+			if !r.NoBracketedPaste {
+				io.WriteString(r, dbp)
+			}
+		}
+		io.WriteString(r, rwrap)
 		r.Restore(state)
 	}()
 
-	if _, err := io.WriteString(r, "\r"+clreos+ebp+prompt); err != nil {
-		return nil, err
+	// Cursor movement relies on auto-wrap. Saving and restoring the mode
+	// (XTSAVE/XTRESTORE) is best effort: xterm and most of its descendants
+	// support it, but elsewhere the sequences are ignored and auto-wrap
+	// stays enabled after reading, which is the usual default anyway.
+	setup := "\r" + clreos + swrap + ewrap
+	if !r.NoBracketedPaste {
+		setup += ebp
+	}
+	if _, err := io.WriteString(r, setup+prompt); err != nil {
+		return nil, false, err
+	}
+	if r.Hint != nil {
+		r.redrawTail(password, pos, transformer)
 	}
 
 	for scanner.Scan() {
 		token := scanner.Bytes()
-		switch action := tokenToAction(token, inPaste); action {
+		action := tokenToAction(token, inPaste)
+		if inPaste && opts.endMarker != nil && len(token) == 1 {
+			if token[0] == '\r' || token[0] == '\n' && !prevCR {
+				action = actEOF
+			} else if token[0] == '\n' {
+				action = actIgnore
+			}
+		}
+		prevCR = len(token) == 1 && token[0] == '\r'
+		staleHint := false
+		switch action {
 		case actEOF:
-			return password, nil
+			if opts.endMarker == nil {
+				return password, true, nil
+			}
+			if pos < len(password) {
+				out, _ := transformer(password[pos:])
+				r.Write(out)
+			}
+			if bytes.Equal(password, opts.endMarker) {
+				r.releaseBuffer(password)
+				if text == nil {
+					text = r.newBuffer(0)
+				}
+				password, pos = text, len(text)
+				return password, true, nil
+			}
+			if text == nil {
+				text = r.newBuffer(cap(password))
+			}
+			text = r.appendBuffer(text, password...)
+			text = r.appendBuffer(text, '\n')
+			for i := range password {
+				password[i] = 0
+			}
+			password, pos = password[:0], 0
+			for _, snap := range undo {
+				r.releaseBuffer(snap.buf)
+			}
+			undo = undo[:0]
+			prompt = "> "
+			io.WriteString(r, "\r\n"+prompt)
+			staleHint = true
 		case actSIGINT:
-			return nil, &SignalError{sig: syscall.SIGINT}
+			return nil, false, &SignalError{sig: syscall.SIGINT}
 		case actSIGQUIT:
-			return nil, &SignalError{sig: syscall.SIGQUIT}
+			return nil, false, &SignalError{sig: syscall.SIGQUIT}
 		case actBeginningOfLine:
 			if pos > 0 {
 				_, n := transformer(password[:pos])
@@ -341,30 +597,32 @@ func (r *reader) ReadRaw(ctx context.Context, prompt string, transformer Transfo
 				password = password[:len(password)-n]
 				pos -= n
 				r.Write(bytes.Repeat(bs, m))
-				out, n := transformer(password[pos:])
-				r.Write(out)
-				io.WriteString(r, clreos)
-				r.Write(bytes.Repeat(bs, n))
+				r.redrawTail(password, pos, transformer)
 			}
 		case actDeleteForwardChar:
 			if pos < len(password) {
 				_, n := utf8.DecodeRune(password[pos:])
 				copy(password[pos:], password[pos+n:])
 				password = password[:len(password)-n]
-				out, n := transformer(password[pos:])
-				r.Write(out)
-				io.WriteString(r, clreos)
-				r.Write(bytes.Repeat(bs, n))
+				r.redrawTail(password, pos, transformer)
 			}
 		case actKillLine:
+			if pos < len(password) {
+				pushUndo()
+			}
 			password = password[:pos]
 			io.WriteString(r, clreos)
+			staleHint = true
 		case actKillWholeLine:
+			if len(password) > 0 {
+				pushUndo()
+			}
 			_, n := transformer(password[:pos])
 			r.Write(bytes.Repeat(bs, n))
 			io.WriteString(r, clreos)
 			password = password[:0]
 			pos = 0
+			staleHint = true
 		case actRefresh:
 			_, n := transformer(password[:pos])
 			r.Write(bytes.Repeat(bs, n))
@@ -373,8 +631,25 @@ func (r *reader) ReadRaw(ctx context.Context, prompt string, transformer Transfo
 			r.Write(out)
 			_, n = transformer(password[pos:])
 			r.Write(bytes.Repeat(bs, n))
+			staleHint = true
+		case actUndo:
+			if len(undo) == 0 {
+				break
+			}
+			snap := undo[len(undo)-1]
+			undo = undo[:len(undo)-1]
+			_, n := transformer(password[:pos])
+			r.Write(bytes.Repeat(bs, n))
+			io.WriteString(r, clreos)
+			r.releaseBuffer(password)
+			password, pos = snap.buf, snap.pos
+			out, _ := transformer(password)
+			r.Write(out)
+			_, n = transformer(password[pos:])
+			r.Write(bytes.Repeat(bs, n))
+			staleHint = true
 		case actPasteStart:
-			inPaste = true
+			inPaste = !r.NoBracketedPaste
 		case actPasteEnd:
 			inPaste = false
 		case actQuotedInsert:
@@ -383,16 +658,30 @@ func (r *reader) ReadRaw(ctx context.Context, prompt string, transformer Transfo
 			}
 			fallthrough
 		case actInsertChar:
+			if opts.allow != nil {
+				if ch, _ := utf8.DecodeRune(token); !opts.allow(ch) {
+					io.WriteString(r, bel)
+					break
+				}
+			}
 			if pos == len(password) {
+				if newlen := len(password) + len(token); newlen > cap(password) {
+					newPassword := r.newBuffer(2 * newlen)
+					newPassword = append(newPassword, password...)
+					r.releaseBuffer(password)
+					password = newPassword
+				}
 				password = append(password, token...)
 				pos = len(password)
 				out, _ := transformer(token)
 				r.Write(out)
+				staleHint = true
 			} else {
 				newlen := len(password) + len(token)
 				if newlen > cap(password) {
-					newPassword := make([]byte, 2*newlen)
-					copy(newPassword, password)
+					newPassword := r.newBuffer(2 * newlen)
+					newPassword = append(newPassword, password...)
+					r.releaseBuffer(password)
 					password = newPassword
 				}
 				password = password[:newlen]
@@ -401,24 +690,167 @@ func (r *reader) ReadRaw(ctx context.Context, prompt string, transformer Transfo
 				pos += len(token)
 				out, _ := transformer(token)
 				r.Write(out)
-				out, n := transformer(password[pos:])
-				r.Write(out)
-				io.WriteString(r, clreos)
-				r.Write(bytes.Repeat(bs, n))
+				r.redrawTail(password, pos, transformer)
 			}
 		}
+		if staleHint && r.Hint != nil {
+			r.redrawTail(password, pos, transformer)
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if text != nil {
+		r.releaseBuffer(text)
+	}
+	return password, false, nil
+}
+
+func (r *reader) redrawTail(line []byte, pos int, transformer Transformer) {
+	out, n := transformer(line[pos:])
+	r.Write(out)
+	if r.Hint != nil {
+		hint, m := CaretNotation([]byte("  " + r.Hint(line)))
+		r.Write(hint)
+		n += m
+	}
+	io.WriteString(r, clreos)
+	r.Write(bytes.Repeat(bs, n))
+}
+
+func (r *reader) readLineSimple(ctx context.Context, prompt string, opts lineOptions) (line []byte, accepted bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+
+	cr, stopWarning := r.newContextReader(ctx, signalCh)
+	defer stopWarning()
+	password := r.newBuffer(256)
+	var text []byte
+	defer func() {
+		if err != nil {
+			r.releaseBuffer(password)
+			if text != nil {
+				r.releaseBuffer(text)
+			}
+		}
+	}()
+
+	state, err := r.MakeRaw()
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		if !r.NoFinalNewline {
+			io.WriteString(r, "\r\n")
+		}
+		r.Restore(state)
+	}()
+
+	if _, err := io.WriteString(r, prompt); err != nil {
+		return nil, false, err
+	}
+
+	b := make([]byte, 1)
+	for {
+		n, err := cr.Read(b)
+		if n == 0 {
+			if err == nil {
+				continue
+			}
+			if err == io.EOF {
+				break
+			}
+			return nil, false, err
+		}
+		switch b[0] {
+		case 0x03: // ^C
+			return nil, false, &SignalError{sig: syscall.SIGINT}
+		case 0x04, '\r', '\n': // ^D, ^M, ^J
+			if opts.endMarker == nil {
+				return password, true, nil
+			}
+			if bytes.Equal(password, opts.endMarker) {
+				r.releaseBuffer(password)
+				if text == nil {
+					text = r.newBuffer(0)
+				}
+				return text, true, nil
+			}
+			if text == nil {
+				text = r.newBuffer(cap(password))
+			}
+			text = r.appendBuffer(text, password...)
+			text = r.appendBuffer(text, '\n')
+			for i := range password {
+				password[i] = 0
+			}
+			password = password[:0]
+			io.WriteString(r, "\r\n> ")
+		case 0x08, 0x7f: // ^H, ^?
+			_, size := utf8.DecodeLastRune(password)
+			for i := len(password) - size; i < len(password); i++ {
+				password[i] = 0
+			}
+			password = password[:len(password)-size]
+		case 0x15: // ^U
+			for i := range password {
+				password[i] = 0
+			}
+			password = password[:0]
+		default:
+			if b[0] < 0x20 && b[0] != '\t' {
+				break
+			}
+			password = r.appendBuffer(password, b[0])
+			start := len(password) - 1
+			for start > 0 && len(password)-start < utf8.UTFMax && !utf8.RuneStart(password[start]) {
+				start--
+			}
+			if !utf8.FullRune(password[start:]) {
+				break
+			}
+			if ch, _ := utf8.DecodeRune(password[start:]); opts.allow != nil && !opts.allow(ch) {
+				for i := start; i < len(password); i++ {
+					password[i] = 0
+				}
+				password = password[:start]
+				io.WriteString(r, bel)
+			}
+		}
+	}
+
+	if text != nil {
+		r.releaseBuffer(text)
 	}
-	return password, nil
+	return password, false, nil
 }
 
 func (r *reader) ReadString(ctx context.Context, prompt string) ([]byte, error) {
 	return r.ReadRaw(ctx, prompt, CaretNotation)
 }
 
+func (r *reader) ReadValidated(ctx context.Context, prompt string, allow func(r rune) bool) ([]byte, error) {
+	line, _, err := r.readLine(ctx, prompt, CaretNotation, lineOptions{allow: allow})
+	return line, err
+}
+
+func (r *reader) ReadMultiline(ctx context.Context, prompt, endMarker string, transformer Transformer) ([]byte, error) {
+	text, accepted, err := r.readLine(ctx, prompt, transformer, lineOptions{endMarker: []byte(endMarker)})
+	if err != nil {
+		return nil, err
+	}
+	if !accepted {
+		r.releaseBuffer(text)
+		return nil, io.ErrUnexpectedEOF
+	}
+	return text, nil
+}
+
 func (r *reader) ReadPassword(ctx context.Context, prompt string) ([]byte, error) {
 	return r.ReadRaw(ctx, prompt, Masked)
 }
@@ -426,3 +858,49 @@ func (r *reader) ReadPassword(ctx context.Context, prompt string) ([]byte, error
 func (r *reader) ReadNoEcho(ctx context.Context, prompt string) ([]byte, error) {
 	return r.ReadRaw(ctx, prompt, NoDisplay)
 }
+
+func (r *reader) ReadChar(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+
+	state, err := r.MakeRaw()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Restore(state)
+
+	// Keys typed ahead stay pending for the next call, and a rune split
+	// across reads is waited for. An escape sequence is assumed to arrive
+	// in a single read, as terminals write it at once, so a lone ESC is
+	// returned without waiting for another key.
+	cr := &contextReader{ctx: ctx, signalCh: signalCh, r: r.tty}
+	buf := make([]byte, 64)
+	for {
+		if len(r.pending) > 0 {
+			advance, token, _ := scanToken(r.pending, false)
+			if advance == 0 && r.pending[0] == '\x1b' {
+				advance, token, _ = scanToken(r.pending, true)
+			}
+			if advance > 0 {
+				token = append([]byte(nil), token...)
+				r.pending = r.pending[advance:]
+				switch tokenToAction(token, false) {
+				case actSIGINT:
+					return nil, &SignalError{sig: syscall.SIGINT}
+				case actSIGQUIT:
+					return nil, &SignalError{sig: syscall.SIGQUIT}
+				}
+				return token, nil
+			}
+		}
+		n, err := cr.Read(buf)
+		r.pending = append(r.pending, buf[:n]...)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package prompt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+	"golang.org/x/text/width"
+)
+
+type fakeTTY struct {
+	io.Reader
+	bytes.Buffer
+	raw bool
+}
+
+func (f *fakeTTY) Read(b []byte) (int, error) {
+	return f.Reader.Read(b)
+}
+
+func (f *fakeTTY) Close() error {
+	return nil
+}
+
+func (f *fakeTTY) MakeRaw() (*term.State, error) {
+	f.raw = true
+	return nil, nil
+}
+
+func (f *fakeTTY) Restore(*term.State) error {
+	f.raw = false
+	return nil
+}
+
+func newTestReader(input io.Reader) (*reader, *fakeTTY) {
+	tty := &fakeTTY{Reader: input}
+	return &reader{tty: tty}, tty
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", "password\r", "password"},
+		{"backspace", "passx\x7fword\r", "password"},
+		{"insert in the middle", "pasword\x02\x02\x02\x02s\r", "password"},
+		{"kill line", "pass\x01\x0bword\r", "word"},
+		{"kill whole line", "wrong\x15password\r", "password"},
+		{"undo", "pass\x15\x1fword\r", "password"},
+		{"arrow keys", "pssword" + strings.Repeat("\x1b[D", 7) + "\x1b[Ca\r", "password"},
+		{"bracketed paste", "\x1b[200~pass\x01word\x1b[201~\r", "pass\x01word"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, tty := newTestReader(strings.NewReader(tt.input))
+			line, accepted, err := r.readLine(context.Background(), "Password: ", CaretNotation, lineOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !accepted {
+				t.Error("line was not accepted")
+			}
+			if string(line) != tt.want {
+				t.Errorf("got %q, want %q", line, tt.want)
+			}
+			if tty.raw {
+				t.Error("terminal was left in raw mode")
+			}
+		})
+	}
+}
+
+func TestReadLineEOF(t *testing.T) {
+	r, _ := newTestReader(strings.NewReader("pass"))
+	line, accepted, err := r.readLine(context.Background(), "Password: ", Masked, lineOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted {
+		t.Errorf("got accepted line %q at end of input", line)
+	}
+}
+
+func TestReadLineSIGINT(t *testing.T) {
+	r, _ := newTestReader(strings.NewReader("pass\x03"))
+	_, _, err := r.readLine(context.Background(), "Password: ", Masked, lineOptions{})
+	if se, ok := err.(*SignalError); !ok || se.Signal() != int(syscall.SIGINT) {
+		t.Errorf("got %v, want SIGINT", err)
+	}
+}
+
+func TestScanTokenIncomplete(t *testing.T) {
+	for _, data := range []string{"\x1b", "\x1b[", "\x1b[20", "\x1b[1;5", "\x1bO", "\xc3", "\xe2\x82"} {
+		if advance, token, err := scanToken([]byte(data), false); advance != 0 || token != nil || err != nil {
+			t.Errorf("scanToken(%q, false) = %d, %q, %v; want more data", data, advance, token, err)
+		}
+		if advance, _, _ := scanToken([]byte(data), true); advance != 1 {
+			t.Errorf("scanToken(%q, true) advanced %d bytes, want 1", data, advance)
+		}
+	}
+}
+
+func TestReadLineOneByteAtATime(t *testing.T) {
+	r, _ := newTestReader(iotest.OneByteReader(strings.NewReader("ac\x1b[Db\x1b[C\xc3\xa9\x1b[200~\xe2\x82\xac\x1b[201~\r")))
+	line, accepted, err := r.readLine(context.Background(), "Password: ", CaretNotation, lineOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "abcé€"; !accepted || string(line) != want {
+		t.Errorf("got %q (accepted=%v), want %q", line, accepted, want)
+	}
+}
+
+// cursorColumn replays what readLine wrote, up to the final newline, and
+// returns the column the cursor ends up in.
+func cursorColumn(out []byte) int {
+	if i := bytes.LastIndex(out, []byte("\r\n")); i >= 0 {
+		out = out[:i]
+	}
+	col := 0
+	for len(out) > 0 {
+		switch {
+		case out[0] == '\x1b' && len(out) > 1 && out[1] == '[':
+			i := 2
+			for i < len(out) && (out[i] < 0x40 || out[i] > 0x7e) {
+				i++
+			}
+			out = out[i+1:]
+			continue
+		case out[0] == '\r':
+			col = 0
+		case out[0] == '\b':
+			col--
+		case out[0] == '\t':
+			col = (col + 8) / 8 * 8
+		case out[0] >= 0x20:
+			r, n := utf8.DecodeRune(out)
+			col++
+			if k := width.LookupRune(r).Kind(); k == width.EastAsianWide || k == width.EastAsianFullwidth {
+				col++
+			}
+			out = out[n:]
+			continue
+		}
+		out = out[1:]
+	}
+	return col
+}
+
+func TestReadLineTab(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		transformer Transformer
+	}{
+		{"CaretNotation", CaretNotation},
+		{"Masked", Masked},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, tty := newTestReader(strings.NewReader("a\tb\x02\x7f\t\x01\x05\r"))
+			line, _, err := r.readLine(context.Background(), "P: ", tt.transformer, lineOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "a\tb"; string(line) != want {
+				t.Errorf("got %q, want %q", line, want)
+			}
+			if bytes.IndexByte(tty.Bytes(), '\t') >= 0 {
+				t.Errorf("a raw tab was echoed: %q", tty.Bytes())
+			}
+			_, width := tt.transformer(line)
+			if got, want := cursorColumn(tty.Bytes()), len("P: ")+width; got != want {
+				t.Errorf("cursor ended in column %d, want %d (output %q)", got, want, tty.Bytes())
+			}
+		})
+	}
+}
+
+func TestReadLineWideCharacters(t *testing.T) {
+	// Insert and delete in the middle of wide characters, so that every
+	// redraw of the tail has to move back over two-column runes.
+	r, tty := newTestReader(strings.NewReader("日本語\x02\x02x\x02\x7f\x06\x06y\r"))
+	line, _, err := r.readLine(context.Background(), "P: ", CaretNotation, lineOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "x本y語"; string(line) != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+	for _, seq := range []string{"\x1b7", "\x1b8", "\x1b[s", "\x1b[u"} {
+		if bytes.Contains(tty.Bytes(), []byte(seq)) {
+			t.Errorf("output saves or restores the cursor with %q", seq)
+		}
+	}
+	if got, want := cursorColumn(tty.Bytes()), len("P: ")+6; got != want {
+		t.Errorf("cursor ended in column %d, want %d (output %q)", got, want, tty.Bytes())
+	}
+}
+
+func TestReadChar(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input io.Reader
+		want  []string
+	}{
+		{
+			"single read",
+			strings.NewReader("ab\x1b[A\xc3\xa9\x1b"),
+			[]string{"a", "b", "\x1b[A", "é", "\x1b"},
+		},
+		{
+			// A rune split across reads is reassembled, an escape
+			// sequence is not.
+			"one byte at a time",
+			iotest.OneByteReader(strings.NewReader("ab\x1b[A\xc3\xa9\x1b")),
+			[]string{"a", "b", "\x1b", "[", "A", "é", "\x1b"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestReader(tt.input)
+			for _, w := range tt.want {
+				key, err := r.ReadChar(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(key) != w {
+					t.Errorf("got %q, want %q", key, w)
+				}
+			}
+			if key, err := r.ReadChar(context.Background()); err != io.EOF {
+				t.Errorf("got %q, %v, want EOF", key, err)
+			}
+		})
+	}
+}
+
+func TestReadCharKeepsTypeahead(t *testing.T) {
+	r, _ := newTestReader(strings.NewReader("ypassword\r"))
+	key, err := r.ReadChar(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "y" {
+		t.Errorf("got key %q, want %q", key, "y")
+	}
+	line, _, err := r.readLine(context.Background(), "Password: ", CaretNotation, lineOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(line) != "password" {
+		t.Errorf("got line %q, want %q", line, "password")
+	}
+}
+
+type slowReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.Reader.Read(b)
+}
+
+func TestDeadlineWarning(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		timeout time.Duration
+		warning time.Duration
+		bell    bool
+		simple  bool
+	}{
+		{"warning due", time.Hour, time.Hour - 10*time.Millisecond, true, false},
+		{"warning due in simple mode", time.Hour, time.Hour - 10*time.Millisecond, true, true},
+		{"less time left than the warning", time.Hour, 2 * time.Hour, false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, tty := newTestReader(&slowReader{Reader: strings.NewReader("ok\r"), delay: 100 * time.Millisecond})
+			r.DeadlineWarning = tt.warning
+			r.Simple = tt.simple
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if _, _, err := r.readLine(ctx, "Password: ", CaretNotation, lineOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(tty.String(), bel); got != tt.bell {
+				t.Errorf("bell rang: got %v, want %v", got, tt.bell)
+			}
+		})
+	}
+}
+
+func TestRepeatedReadPasswordDoesNotLeak(t *testing.T) {
+	const n = 50
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	countFDs := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			return -1
+		}
+		return len(entries)
+	}
+	r, _ := newTestReader(pr)
+	var fds, goroutines int
+	for i := 0; i < n; i++ {
+		if i == 1 {
+			// The first read starts the signal handling goroutine, which
+			// stays for the rest of the process.
+			fds = countFDs()
+			goroutines = runtime.NumGoroutine()
+		}
+		if _, err := io.WriteString(pw, "password\r"); err != nil {
+			t.Fatal(err)
+		}
+		password, err := r.ReadPassword(context.Background(), "Password: ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(password) != "password" {
+			t.Fatalf("got %q, want %q", password, "password")
+		}
+	}
+
+	if got := countFDs(); got != fds {
+		t.Errorf("open file descriptors: got %d, want %d", got, fds)
+	}
+	// The goroutines that returned each read may take a moment to exit.
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > goroutines {
+		t.Errorf("goroutines: got %d, want at most %d", got, goroutines)
+	}
+}
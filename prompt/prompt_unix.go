@@ -13,6 +13,8 @@ import (
 	"golang.org/x/term"
 )
 
+var errBackground = errors.New("cannot read from the terminal while running in the background")
+
 type unixTTY struct {
 	tty         *os.File
 	needToClose bool
@@ -53,9 +55,32 @@ func (t *unixTTY) Close() error {
 }
 
 func (t *unixTTY) MakeRaw() (*term.State, error) {
-	return term.MakeRaw(int(t.tty.Fd()))
+	// A background process reading from (or changing the mode of) its
+	// controlling terminal is stopped by SIGTTIN/SIGTTOU, which looks like
+	// a hang to the user.
+	fd := int(t.tty.Fd())
+	if fg, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP); err == nil {
+		if pgrp, err := unix.Getpgid(0); err == nil && fg != pgrp {
+			return nil, errBackground
+		}
+	}
+	return term.MakeRaw(fd)
 }
 
 func (t *unixTTY) Restore(oldState *term.State) error {
 	return term.Restore(int(t.tty.Fd()), oldState)
 }
+
+func allocLocked(size int) []byte {
+	b, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil
+	}
+	unix.Mlock(b)
+	return b
+}
+
+func freeLocked(b []byte) {
+	unix.Munlock(b)
+	unix.Munmap(b)
+}
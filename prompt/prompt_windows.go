@@ -6,12 +6,22 @@
 package prompt
 
 import (
+	"errors"
 	"os"
+	"reflect"
+	"unsafe"
 
 	"golang.org/x/sys/windows"
 	"golang.org/x/term"
 )
 
+var (
+	getConsoleMode = windows.GetConsoleMode
+	setConsoleMode = windows.SetConsoleMode
+)
+
+var errNoVirtualTerminal = errors.New("the console does not support virtual terminal sequences")
+
 type windowsTTY struct {
 	conin, conout   *os.File
 	inMode, outMode uint32
@@ -50,16 +60,18 @@ func (t *windowsTTY) Close() error {
 }
 
 func (t *windowsTTY) MakeRaw() (*term.State, error) {
-	if err := windows.GetConsoleMode(windows.Handle(t.conin.Fd()), &t.inMode); err != nil {
+	if err := getConsoleMode(windows.Handle(t.conin.Fd()), &t.inMode); err != nil {
 		return nil, err
 	}
-
-	var mode uint32 = windows.ENABLE_VIRTUAL_TERMINAL_INPUT
-	if err := windows.SetConsoleMode(windows.Handle(t.conin.Fd()), mode); err != nil {
+	if err := getConsoleMode(windows.Handle(t.conout.Fd()), &t.outMode); err != nil {
 		return nil, err
 	}
 
-	if err := windows.GetConsoleMode(windows.Handle(t.conout.Fd()), &t.outMode); err != nil {
+	var mode uint32 = windows.ENABLE_VIRTUAL_TERMINAL_INPUT
+	if err := setConsoleMode(windows.Handle(t.conin.Fd()), mode); err != nil {
+		if err == windows.ERROR_INVALID_PARAMETER {
+			return nil, errNoVirtualTerminal
+		}
 		return nil, err
 	}
 
@@ -67,7 +79,11 @@ func (t *windowsTTY) MakeRaw() (*term.State, error) {
 	mode |= windows.ENABLE_WRAP_AT_EOL_OUTPUT
 	mode |= windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING
 	mode |= windows.DISABLE_NEWLINE_AUTO_RETURN
-	if err := windows.SetConsoleMode(windows.Handle(t.conout.Fd()), mode); err != nil {
+	if err := setConsoleMode(windows.Handle(t.conout.Fd()), mode); err != nil {
+		setConsoleMode(windows.Handle(t.conin.Fd()), t.inMode)
+		if err == windows.ERROR_INVALID_PARAMETER {
+			return nil, errNoVirtualTerminal
+		}
 		return nil, err
 	}
 
@@ -75,11 +91,31 @@ func (t *windowsTTY) MakeRaw() (*term.State, error) {
 }
 
 func (t *windowsTTY) Restore(oldState *term.State) error {
-	if err := windows.SetConsoleMode(windows.Handle(t.conin.Fd()), t.inMode); err != nil {
+	if err := setConsoleMode(windows.Handle(t.conin.Fd()), t.inMode); err != nil {
 		return err
 	}
-	if err := windows.SetConsoleMode(windows.Handle(t.conout.Fd()), t.outMode); err != nil {
+	if err := setConsoleMode(windows.Handle(t.conout.Fd()), t.outMode); err != nil {
 		return err
 	}
 	return nil
 }
+
+func allocLocked(size int) []byte {
+	addr, err := windows.VirtualAlloc(0, uintptr(size), windows.MEM_COMMIT|windows.MEM_RESERVE, windows.PAGE_READWRITE)
+	if err != nil {
+		return nil
+	}
+	windows.VirtualLock(addr, uintptr(size))
+	var b []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	hdr.Data = addr
+	hdr.Len = size
+	hdr.Cap = size
+	return b
+}
+
+func freeLocked(b []byte) {
+	addr := uintptr(unsafe.Pointer(&b[0]))
+	windows.VirtualUnlock(addr, uintptr(cap(b)))
+	windows.VirtualFree(addr, 0, windows.MEM_RELEASE)
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+// +build windows
+
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestMakeRawRestoresInputModeOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	conin, err := os.Create(filepath.Join(dir, "conin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conin.Close()
+	conout, err := os.Create(filepath.Join(dir, "conout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conout.Close()
+
+	const inMode, outMode = 0x1f7, 0x3
+	modes := map[windows.Handle]uint32{
+		windows.Handle(conin.Fd()):  inMode,
+		windows.Handle(conout.Fd()): outMode,
+	}
+	calls := 0
+	defer func(get func(windows.Handle, *uint32) error, set func(windows.Handle, uint32) error) {
+		getConsoleMode, setConsoleMode = get, set
+	}(getConsoleMode, setConsoleMode)
+	getConsoleMode = func(h windows.Handle, mode *uint32) error {
+		*mode = modes[h]
+		return nil
+	}
+	setConsoleMode = func(h windows.Handle, mode uint32) error {
+		calls++
+		if calls == 2 {
+			return windows.ERROR_INVALID_PARAMETER
+		}
+		modes[h] = mode
+		return nil
+	}
+
+	tty := &windowsTTY{conin: conin, conout: conout}
+	if _, err := tty.MakeRaw(); err != errNoVirtualTerminal {
+		t.Errorf("MakeRaw: got %v, want %v", err, errNoVirtualTerminal)
+	}
+	if got := modes[windows.Handle(conin.Fd())]; got != inMode {
+		t.Errorf("input mode left at %#x, want %#x", got, inMode)
+	}
+	if got := modes[windows.Handle(conout.Fd())]; got != outMode {
+		t.Errorf("output mode changed to %#x, want %#x", got, outMode)
+	}
+}
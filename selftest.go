@@ -0,0 +1,115 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	selftestPassword  = "password"
+	selftestPlaintext = "The secret message"
+	selftestVector    = "AQEAAAAIAAAAAbuHbgTOXyYivhEyrCgotQvbCFggO1GtiszxHKh0WTKflgBSbEIU" +
+		"+PgM9sHMp29aWSRhFtvO6PZCCjf3QLSch5RAjd/dd88GgWXT"
+)
+
+func selftestDecrypt(ciphertext []byte, password, ad string) ([]byte, *options, error) {
+	opts := &options{Quiet: true}
+	plaintext := new(bytes.Buffer)
+	_, err := decrypt(bytes.NewReader(ciphertext), plaintext, []byte(password), []byte(ad), opts)
+	return plaintext.Bytes(), opts, err
+}
+
+func selftestKnownAnswer() error {
+	vector, err := base64.StdEncoding.DecodeString(selftestVector)
+	if err != nil {
+		return err
+	}
+	plaintext, opts, err := selftestDecrypt(vector, selftestPassword, "")
+	if err != nil {
+		return err
+	}
+	if opts.Time != 1 || opts.Memory != 8 || opts.Threads != 1 {
+		return fmt.Errorf("header parsed as time=%d, memory=%d, parallelism=%d", opts.Time, opts.Memory, opts.Threads)
+	}
+	if string(plaintext) != selftestPlaintext {
+		return errors.New("plaintext does not match")
+	}
+	return nil
+}
+
+func selftestRejects() error {
+	vector, err := base64.StdEncoding.DecodeString(selftestVector)
+	if err != nil {
+		return err
+	}
+	if _, _, err := selftestDecrypt(vector, "wrong password", ""); !errors.Is(err, errInvalidTag) {
+		return fmt.Errorf("wrong password: got %v", err)
+	}
+	if _, _, err := selftestDecrypt(vector, selftestPassword, "name"); !errors.Is(err, errInvalidTag) {
+		return fmt.Errorf("wrong file name: got %v", err)
+	}
+	for _, i := range []int{2, headerSize - 1, headerSize, len(vector) - 1} {
+		tampered := append([]byte(nil), vector...)
+		tampered[i] ^= 0x01
+		if _, _, err := selftestDecrypt(tampered, selftestPassword, ""); !errors.Is(err, errInvalidTag) {
+			return fmt.Errorf("flipped byte %d: got %v", i, err)
+		}
+	}
+	return nil
+}
+
+func selftestRoundTrip() error {
+	plaintext := make([]byte, 4096)
+	if _, err := rand.Read(plaintext); err != nil {
+		return err
+	}
+	opts := &options{Time: 1, Memory: 8, Threads: 1}
+	ciphertext := new(bytes.Buffer)
+	n, err := encrypt(bytes.NewReader(append([]byte(nil), plaintext...)), ciphertext, []byte(selftestPassword), []byte("name"), opts)
+	if err != nil {
+		return err
+	}
+	if n != len(plaintext)+overhead || ciphertext.Len() != n {
+		return fmt.Errorf("wrote %d bytes, expected %d", ciphertext.Len(), len(plaintext)+overhead)
+	}
+	decrypted, _, err := selftestDecrypt(ciphertext.Bytes(), selftestPassword, "name")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		return errors.New("plaintext does not match")
+	}
+	return nil
+}
+
+func selftest(w io.Writer) error {
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"known-answer vector", selftestKnownAnswer},
+		{"authentication failures", selftestRejects},
+		{"encrypt/decrypt round trip", selftestRoundTrip},
+	}
+
+	failed := 0
+	for _, test := range tests {
+		if err := test.run(); err != nil {
+			fmt.Fprintf(w, "%-28s FAILED (%v)\n", test.name, err)
+			failed++
+		} else {
+			fmt.Fprintf(w, "%-28s ok\n", test.name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d self-tests failed", failed, len(tests))
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+// +build windows
+
+package main
+
+// syncDir does nothing, since NTFS journals renames and directories
+// cannot be flushed.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2020-2021 cions
+// Licensed under the MIT License. See LICENSE for details
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func volumeName(name string, index int) string {
+	return fmt.Sprintf("%s.%03d", name, index)
+}
+
+type splitOutput struct {
+	name      string
+	size      int64
+	mode      os.FileMode
+	noClobber bool
+	volumes   []*outputFile
+	written   int64
+}
+
+func createSplitOutput(name string, size int64, mode os.FileMode, noClobber bool) *splitOutput {
+	return &splitOutput{name: name, size: size, mode: mode, noClobber: noClobber}
+}
+
+func (s *splitOutput) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if len(s.volumes) == 0 || s.written == s.size {
+			volume, err := createOutput(volumeName(s.name, len(s.volumes)), s.mode, s.noClobber)
+			if err != nil {
+				return n, err
+			}
+			s.volumes = append(s.volumes, volume)
+			s.written = 0
+		}
+		chunk := b
+		if int64(len(chunk)) > s.size-s.written {
+			chunk = chunk[:s.size-s.written]
+		}
+		m, err := s.volumes[len(s.volumes)-1].Write(chunk)
+		n += m
+		s.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
+
+func (s *splitOutput) Reopen() (io.ReadCloser, error) {
+	names := make([]string, len(s.volumes))
+	for i, volume := range s.volumes {
+		names[i] = volume.Name()
+	}
+	return openVolumes(names)
+}
+
+func (s *splitOutput) Commit() error {
+	if err := checkClobber("open", volumeName(s.name, len(s.volumes)), s.noClobber); err != nil {
+		s.Abort()
+		return err
+	}
+	// Every volume is made durable before any replaces an old one, so a
+	// failure up to here leaves the old set untouched.
+	for _, volume := range s.volumes {
+		if err := volume.finish(); err != nil {
+			s.Abort()
+			return err
+		}
+	}
+	for i, volume := range s.volumes {
+		if err := volume.publish(); err != nil {
+			s.Abort()
+			if i == 0 && !volume.published {
+				return err
+			}
+			return s.inconsistent(err)
+		}
+	}
+	for i := len(s.volumes); ; i++ {
+		err := os.Remove(volumeName(s.name, i))
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			return s.inconsistent(err)
+		}
+	}
+	return syncDir(filepath.Dir(s.name))
+}
+
+func (s *splitOutput) inconsistent(err error) error {
+	return fmt.Errorf("%w (the volume set %s on disk mixes new and old volumes)", err, s.name+".*")
+}
+
+func (s *splitOutput) Abort() {
+	for _, volume := range s.volumes {
+		volume.Abort()
+	}
+}
+
+type volumeReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (vr *volumeReader) Close() error {
+	var err error
+	for _, fh := range vr.files {
+		if err2 := fh.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func openVolumes(names []string) (io.ReadCloser, error) {
+	vr := &volumeReader{}
+	readers := make([]io.Reader, len(names))
+	for i, name := range names {
+		fh, err := os.Open(name)
+		if err != nil {
+			vr.Close()
+			return nil, err
+		}
+		vr.files = append(vr.files, fh)
+		readers[i] = fh
+	}
+	vr.Reader = io.MultiReader(readers...)
+	return vr, nil
+}
+
+func findVolumes(name string) ([]string, error) {
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	last := -1
+	found := make(map[int]bool)
+	for _, entry := range entries {
+		suffix := strings.TrimPrefix(entry.Name(), base+".")
+		if suffix == entry.Name() || strings.Trim(suffix, "0123456789") != "" {
+			continue
+		}
+		index, err := strconv.Atoi(suffix)
+		if err != nil || volumeName(base, index) != entry.Name() {
+			continue
+		}
+		found[index] = true
+		if index > last {
+			last = index
+		}
+	}
+	if last < 0 {
+		return nil, nil
+	}
+
+	names := make([]string, last+1)
+	for i := range names {
+		names[i] = volumeName(name, i)
+		if !found[i] {
+			return nil, fmt.Errorf("volume %s is missing", names[i])
+		}
+	}
+	return names, nil
+}